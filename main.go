@@ -3,26 +3,44 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/sys/unix"
 )
 
 const (
-	KILO_VERSION    = "0.0.1"
-	KILO_TAB_STOP   = 8
-	KILO_QUIT_TIMES = 3
+	KILO_VERSION     = "0.0.1"
+	KILO_TAB_STOP    = 8
+	KILO_QUIT_TIMES  = 3
+	KILO_UNDO_LEVELS = 1000
+	KILO_OSC52_MAX   = 100000
+	KILO_BLOCK_ROWS  = 1024
+
+	KILO_SWAP_INTERVAL = 2 * time.Second
+	KILO_DISK_INTERVAL = 2 * time.Second
 )
 
 const (
 	BACKSPACE  int = 127
-	ARROW_LEFT int = iota + 1000
+	ARROW_LEFT int = iota + utf8.MaxRune
 	ARROW_RIGHT
 	ARROW_UP
 	ARROW_DOWN
@@ -31,6 +49,14 @@ const (
 	END_KEY
 	PAGE_UP
 	PAGE_DOWN
+	SHIFT_ARROW_LEFT
+	SHIFT_ARROW_RIGHT
+	SHIFT_ARROW_UP
+	SHIFT_ARROW_DOWN
+	SHIFT_HOME
+	SHIFT_END
+	MOUSE_EVENT
+	PASTE_EVENT
 )
 
 const (
@@ -42,6 +68,41 @@ const (
 	HL_STRING
 	HL_NUMBER
 	HL_MATCH
+	HL_MATCH_OTHER
+)
+
+const (
+	UNDO_INSERT_ROW int = iota
+	UNDO_DEL_ROW
+	UNDO_INSERT_STR
+	UNDO_DEL_STR
+	UNDO_INSERT_ROWS
+	UNDO_DEL_ROWS
+)
+
+const (
+	UNDO_KIND_NONE int = iota
+	UNDO_KIND_INSERT
+	UNDO_KIND_DELETE
+)
+
+const (
+	SPLIT_NONE int = iota
+	SPLIT_HORIZONTAL
+	SPLIT_VERTICAL
+)
+
+const (
+	LINE_NUMBERS_OFF int = iota
+	LINE_NUMBERS_ABSOLUTE
+	LINE_NUMBERS_RELATIVE
+	LINE_NUMBERS_HYBRID
+)
+
+const (
+	WRAP_OFF int = iota
+	WRAP_CHAR
+	WRAP_WORD
 )
 
 const (
@@ -62,6 +123,7 @@ type EditorSyntax struct {
 }
 
 type EditorRow struct {
+	block         *EditorRowBlock
 	idx           int
 	size          int
 	rSize         int
@@ -71,32 +133,173 @@ type EditorRow struct {
 	hlOpenComment bool
 }
 
+type EditorRowBlock struct {
+	start int
+	rows  []EditorRow
+}
+
+type EditorUndoOp struct {
+	op    int
+	cy    int
+	cx    int
+	s     string
+	lines []string
+}
+
+type EditorUndoGroup struct {
+	ops      []EditorUndoOp
+	cxBefore int
+	cyBefore int
+	cxAfter  int
+	cyAfter  int
+}
+
+type EditorFileStat struct {
+	modTime time.Time
+	size    int64
+	hash    [sha256.Size]byte
+}
+
+type EditorFormat struct {
+	crlf   bool
+	bom    bool
+	noEol  bool
+	binary bool
+}
+
+type EditorBuffer struct {
+	numOfRows int
+	blocks    []*EditorRowBlock
+	filename  string
+	disk      *EditorFileStat
+	format    EditorFormat
+	readOnly  bool
+
+	dirty int
+
+	cx     int
+	cy     int
+	rowOff int
+	colOff int
+
+	undoStack      []EditorUndoGroup
+	redoStack      []EditorUndoGroup
+	undoOpen       bool
+	undoKind       int
+	undoLocked     bool
+	undoSavedLevel int
+
+	mark       bool
+	markSticky bool
+	markCx     int
+	markCy     int
+
+	swapFile     string
+	swapDirty    int
+	swapTime     time.Time
+	swapDisabled bool
+
+	syntax *EditorSyntax
+}
+
+type EditorWindow struct {
+	buf *EditorBuffer
+
+	cx     int
+	cy     int
+	rx     int
+	rowOff int
+	colOff int
+	segOff int
+
+	top  int
+	left int
+	rows int
+	cols int
+}
+
+type EditorLayout struct {
+	parent *EditorLayout
+	win    *EditorWindow
+
+	split  int
+	ratio  float64
+	first  *EditorLayout
+	second *EditorLayout
+
+	top  int
+	left int
+	rows int
+	cols int
+}
+
 type EditorConfig struct {
 	cx          int
 	cy          int
 	rx          int
 	rowOff      int
 	colOff      int
+	segOff      int
+	curRow      int
+	curCol      int
 	screenRows  int
 	screenCols  int
+	termRows    int
+	termCols    int
+	gutterWidth int
+	lineNumbers int
+	wrap        int
 	origTermios *unix.Termios
+	tty         *os.File
+	winch       chan os.Signal
+	term        chan os.Signal
 
-	numOfRows int
-	row       []EditorRow
-	filename  string
+	readingCommand bool
+	viewMode       bool
+	syntaxName     string
+	diskCheckBuf   *EditorBuffer
+	diskCheckTime  time.Time
+
+	buf     *EditorBuffer
+	buffers []*EditorBuffer
+
+	win    *EditorWindow
+	layout *EditorLayout
 
 	statusMsg     string
 	statusMsgTime time.Time
 
-	dirty     int
 	quitTimes int
 
 	findLastMatch   int
 	findDirection   int
 	findSavedHlLine int
 	findSavedHl     []byte
-
-	syntax *EditorSyntax
+	findRegex       bool
+	findIgnoreCase  bool
+	findWholeWord   bool
+	findPattern     *regexp.Regexp
+	findQuery       string
+	findActive      bool
+	findBuf         *EditorBuffer
+	findIndex       int
+	findCount       int
+
+	promptInfo string
+
+	mouseButton  int
+	mouseX       int
+	mouseY       int
+	mouseRelease bool
+
+	pasteText    string
+	pendingInput []byte
+
+	backup bool
+
+	clipboard        string
+	clipboardBackend string
+	clipboardPending string
 }
 
 var e EditorConfig
@@ -124,21 +327,84 @@ var hldb = []EditorSyntax{
 	},
 }
 
+var wideTable = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x1100, Hi: 0x115f, Stride: 1},
+		{Lo: 0x231a, Hi: 0x231b, Stride: 1},
+		{Lo: 0x2329, Hi: 0x232a, Stride: 1},
+		{Lo: 0x23e9, Hi: 0x23ec, Stride: 1},
+		{Lo: 0x23f0, Hi: 0x23f3, Stride: 3},
+		{Lo: 0x25fd, Hi: 0x25fe, Stride: 1},
+		{Lo: 0x2614, Hi: 0x2615, Stride: 1},
+		{Lo: 0x2648, Hi: 0x2653, Stride: 1},
+		{Lo: 0x267f, Hi: 0x2693, Stride: 20},
+		{Lo: 0x26a1, Hi: 0x26a1, Stride: 1},
+		{Lo: 0x26aa, Hi: 0x26ab, Stride: 1},
+		{Lo: 0x26bd, Hi: 0x26be, Stride: 1},
+		{Lo: 0x26c4, Hi: 0x26c5, Stride: 1},
+		{Lo: 0x26ce, Hi: 0x26d4, Stride: 6},
+		{Lo: 0x26ea, Hi: 0x26ea, Stride: 1},
+		{Lo: 0x26f2, Hi: 0x26f3, Stride: 1},
+		{Lo: 0x26f5, Hi: 0x26fa, Stride: 5},
+		{Lo: 0x26fd, Hi: 0x26fd, Stride: 1},
+		{Lo: 0x2705, Hi: 0x2705, Stride: 1},
+		{Lo: 0x270a, Hi: 0x270b, Stride: 1},
+		{Lo: 0x2728, Hi: 0x2728, Stride: 1},
+		{Lo: 0x274c, Hi: 0x274e, Stride: 2},
+		{Lo: 0x2753, Hi: 0x2755, Stride: 1},
+		{Lo: 0x2757, Hi: 0x2757, Stride: 1},
+		{Lo: 0x2795, Hi: 0x2797, Stride: 1},
+		{Lo: 0x27b0, Hi: 0x27bf, Stride: 15},
+		{Lo: 0x2b1b, Hi: 0x2b1c, Stride: 1},
+		{Lo: 0x2b50, Hi: 0x2b55, Stride: 5},
+		{Lo: 0x2e80, Hi: 0x303e, Stride: 1},
+		{Lo: 0x3041, Hi: 0xa4cf, Stride: 1},
+		{Lo: 0xa960, Hi: 0xa97f, Stride: 1},
+		{Lo: 0xac00, Hi: 0xd7a3, Stride: 1},
+		{Lo: 0xf900, Hi: 0xfaff, Stride: 1},
+		{Lo: 0xfe10, Hi: 0xfe19, Stride: 1},
+		{Lo: 0xfe30, Hi: 0xfe6f, Stride: 1},
+		{Lo: 0xff00, Hi: 0xff60, Stride: 1},
+		{Lo: 0xffe0, Hi: 0xffe6, Stride: 1},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x16fe0, Hi: 0x16fe4, Stride: 1},
+		{Lo: 0x17000, Hi: 0x18aff, Stride: 1},
+		{Lo: 0x1b000, Hi: 0x1b2ff, Stride: 1},
+		{Lo: 0x1f004, Hi: 0x1f004, Stride: 1},
+		{Lo: 0x1f0cf, Hi: 0x1f0cf, Stride: 1},
+		{Lo: 0x1f18e, Hi: 0x1f18e, Stride: 1},
+		{Lo: 0x1f191, Hi: 0x1f19a, Stride: 1},
+		{Lo: 0x1f1e6, Hi: 0x1f1ff, Stride: 1},
+		{Lo: 0x1f200, Hi: 0x1f251, Stride: 1},
+		{Lo: 0x1f300, Hi: 0x1f64f, Stride: 1},
+		{Lo: 0x1f680, Hi: 0x1f6ff, Stride: 1},
+		{Lo: 0x1f900, Hi: 0x1f9ff, Stride: 1},
+		{Lo: 0x1fa70, Hi: 0x1faff, Stride: 1},
+		{Lo: 0x20000, Hi: 0x2fffd, Stride: 1},
+		{Lo: 0x30000, Hi: 0x3fffd, Stride: 1},
+	},
+}
+
 func die(fn string, err error) {
+	editorSwapUpdate(true)
+
 	os.Stdout.WriteString("\x1b[2J")
 	os.Stdout.WriteString("\x1b[H")
+	disableRawMode()
 
 	fmt.Fprintf(os.Stderr, "%s: %v", fn, err)
 	os.Exit(1)
 }
 
 func enableRawMode() {
-	raw, err := unix.IoctlGetTermios(int(os.Stdin.Fd()), unix.TCGETS)
+	raw, err := unix.IoctlGetTermios(int(e.tty.Fd()), unix.TCGETS)
 	if err != nil {
 		die("IoctlGetTermios", err)
 	}
 
-	e.origTermios = raw
+	orig := *raw
+	e.origTermios = &orig
 
 	raw.Iflag &= ^uint32(unix.IXON | unix.ICRNL | unix.BRKINT | unix.INPCK | unix.ISTRIP)
 	raw.Oflag &= ^uint32(unix.OPOST)
@@ -148,15 +414,22 @@ func enableRawMode() {
 	raw.Cc[unix.VMIN] = 0
 	raw.Cc[unix.VTIME] = 1
 
-	err = unix.IoctlSetTermios(int(os.Stderr.Fd()), unix.TCSETS, raw)
+	err = unix.IoctlSetTermios(int(e.tty.Fd()), unix.TCSETS, raw)
 	if err != nil {
 		die("IoctlSetTermios", err)
 	}
+
+	os.Stdout.WriteString("\x1b[?1000h\x1b[?1002h\x1b[?1006h\x1b[?2004h")
 }
 
 func disableRawMode() {
 	if e.origTermios != nil {
-		err := unix.IoctlSetTermios(int(os.Stderr.Fd()), unix.TCSETS, e.origTermios)
+		orig := e.origTermios
+		e.origTermios = nil
+
+		os.Stdout.WriteString("\x1b[?2004l\x1b[?1006l\x1b[?1002l\x1b[?1000l")
+
+		err := unix.IoctlSetTermios(int(e.tty.Fd()), unix.TCSETS, orig)
 		if err != nil {
 			die("IoctlSetTermios", err)
 		}
@@ -171,7 +444,7 @@ func editorReadKey() int {
 	b := make([]byte, 1)
 
 	for {
-		n, err := os.Stdin.Read(b)
+		n, err := editorRead(b)
 		if err != nil {
 			if err.Error() != "EOF" {
 				die("editorReadKey", err)
@@ -181,47 +454,92 @@ func editorReadKey() int {
 		if n > 0 {
 			break
 		}
+
+		select {
+		case <-e.winch:
+			editorHandleResize()
+		case <-e.term:
+			editorSwapUpdate(true)
+			disableRawMode()
+			os.Exit(1)
+		default:
+			editorSwapUpdate(false)
+			editorDiskCheck()
+		}
 	}
 
 	if b[0] == '\x1b' {
-		seq := make([]byte, 3)
+		seq := make([]byte, 2)
 
-		n, err := os.Stdin.Read(b)
+		n, err := editorRead(b)
 		if err != nil || n < 1 {
 			return '\x1b'
 		}
 		seq[0] = b[0]
 
-		n, err = os.Stdin.Read(b)
+		n, err = editorRead(b)
 		if err != nil || n < 1 {
 			return '\x1b'
 		}
 		seq[1] = b[0]
 
 		if seq[0] == '[' {
-			if seq[1] > '0' && seq[1] < '9' {
-				n, err = os.Stdin.Read(b)
-				if err != nil || n < 1 {
+			if seq[1] == '<' {
+				return editorReadMouse()
+			}
+
+			if seq[1] > '0' && seq[1] <= '9' {
+				num := int(seq[1] - '0')
+				final, ok := editorReadByte()
+				for ok && final >= '0' && final <= '9' {
+					num = num*10 + int(final-'0')
+					final, ok = editorReadByte()
+				}
+				if !ok {
+					return '\x1b'
+				}
+
+				if final == ';' {
+					mod, ok := editorReadByte()
+					if !ok {
+						return '\x1b'
+					}
+					final, ok := editorReadByte()
+					if !ok || mod != '2' {
+						return '\x1b'
+					}
+
+					switch final {
+					case 'A':
+						return SHIFT_ARROW_UP
+					case 'B':
+						return SHIFT_ARROW_DOWN
+					case 'C':
+						return SHIFT_ARROW_RIGHT
+					case 'D':
+						return SHIFT_ARROW_LEFT
+					case 'H':
+						return SHIFT_HOME
+					case 'F':
+						return SHIFT_END
+					}
 					return '\x1b'
 				}
-				seq[2] = b[0]
 
-				if seq[2] == '~' {
-					switch seq[1] {
-					case '1':
+				if final == '~' {
+					switch num {
+					case 1, 7:
 						return HOME_KEY
-					case '3':
+					case 3:
 						return DEL_KEY
-					case '4':
+					case 4, 8:
 						return END_KEY
-					case '5':
+					case 5:
 						return PAGE_UP
-					case '6':
+					case 6:
 						return PAGE_DOWN
-					case '7':
-						return HOME_KEY
-					case '8':
-						return END_KEY
+					case 200:
+						return editorReadPaste()
 					}
 				}
 
@@ -247,9 +565,134 @@ func editorReadKey() int {
 		return '\x1b'
 	}
 
+	if b[0] >= 0x80 {
+		return editorReadRune(b[0])
+	}
+
 	return int(b[0])
 }
 
+func editorReadMouse() int {
+	var params [3]int
+	i := 0
+	for {
+		c, ok := editorReadByte()
+		if !ok {
+			return '\x1b'
+		}
+
+		switch {
+		case c >= '0' && c <= '9':
+			params[i] = params[i]*10 + int(c-'0')
+		case c == ';' && i < 2:
+			i++
+		case c == 'M' || c == 'm':
+			e.mouseButton = params[0]
+			e.mouseX = params[1] - 1
+			e.mouseY = params[2] - 1
+			e.mouseRelease = c == 'm'
+			return MOUSE_EVENT
+		default:
+			return '\x1b'
+		}
+	}
+}
+
+func editorRead(b []byte) (int, error) {
+	if len(e.pendingInput) > 0 {
+		n := copy(b, e.pendingInput)
+		e.pendingInput = e.pendingInput[n:]
+		return n, nil
+	}
+	return e.tty.Read(b)
+}
+
+func editorReadPaste() int {
+	const end = "\x1b[201~"
+
+	var data []byte
+	chunk := make([]byte, 4096)
+	idle := 0
+	for idle < 50 {
+		n, err := editorRead(chunk)
+		if err != nil && err != io.EOF {
+			break
+		}
+		if n == 0 {
+			idle++
+			continue
+		}
+		idle = 0
+
+		start := max(len(data)-len(end)+1, 0)
+		data = append(data, chunk[:n]...)
+		if i := bytes.Index(data[start:], []byte(end)); i >= 0 {
+			i += start
+			e.pendingInput = append(e.pendingInput, data[i+len(end):]...)
+			data = data[:i]
+			break
+		}
+	}
+
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	e.pasteText = strings.ReplaceAll(text, "\r", "\n")
+	return PASTE_EVENT
+}
+
+func editorReadByte() (byte, bool) {
+	b := make([]byte, 1)
+	n, err := editorRead(b)
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return b[0], true
+}
+
+func editorReadRune(lead byte) int {
+	size := 1
+	switch {
+	case lead&0xe0 == 0xc0:
+		size = 2
+	case lead&0xf0 == 0xe0:
+		size = 3
+	case lead&0xf8 == 0xf0:
+		size = 4
+	}
+
+	buff := []byte{lead}
+	b := make([]byte, 1)
+	for len(buff) < size {
+		n, err := editorRead(b)
+		if err != nil || n < 1 {
+			break
+		}
+		buff = append(buff, b[0])
+	}
+
+	r, _ := utf8.DecodeRune(buff)
+	return int(r)
+}
+
+func editorHandleResize() {
+	for len(e.winch) > 0 {
+		<-e.winch
+	}
+
+	c, r, err := getWindowSize()
+	if err != nil || c <= 0 || r <= 0 {
+		return
+	}
+
+	e.termCols = c
+	e.termRows = r
+	editorStoreWindow(e.win)
+	editorLayoutWindows(e.layout, 0, 0, e.termRows-1, e.termCols)
+	editorLoadWindow(e.win)
+
+	os.Stdout.WriteString("\x1b[2J")
+	editorRefreshScreen()
+}
+
 func getCursorPosition() (int, int, error) {
 	_, err := os.Stdout.WriteString("\x1b[6n")
 	if err != nil {
@@ -261,7 +704,7 @@ func getCursorPosition() (int, int, error) {
 
 	for {
 		b := make([]byte, 1)
-		n, _ := os.Stdin.Read(b)
+		n, _ := e.tty.Read(b)
 		if n < 1 {
 			break
 		}
@@ -284,7 +727,7 @@ func getCursorPosition() (int, int, error) {
 }
 
 func getWindowSize() (int, int, error) {
-	size, err := unix.IoctlGetWinsize(int(os.Stdin.Fd()), unix.TIOCGWINSZ)
+	size, err := unix.IoctlGetWinsize(int(e.tty.Fd()), unix.TIOCGWINSZ)
 	if err != nil || size.Col == 0 {
 		_, err = os.Stdout.WriteString("\x1b[999C\x1b[999B")
 		if err != nil {
@@ -313,22 +756,144 @@ func isSeparator(ch rune) bool {
 	return unicode.IsSpace(rune(ch))
 }
 
+func isWordChar(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func runeWidth(r rune) int {
+	if r == 0x200d || unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf) {
+		return 0
+	}
+	if unicode.Is(wideTable, r) {
+		return 2
+	}
+	return 1
+}
+
+func isGraphemeExtend(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc) ||
+		(r >= 0xfe00 && r <= 0xfe0f) ||
+		(r >= 0xe0100 && r <= 0xe01ef) ||
+		(r >= 0x1f3fb && r <= 0x1f3ff) ||
+		r == 0x200d
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+func graphemeLen(s string) int {
+	if s == "" {
+		return 0
+	}
+	if s[0] < utf8.RuneSelf && (len(s) == 1 || s[1] < utf8.RuneSelf) {
+		return 1
+	}
+
+	r, size := utf8.DecodeRuneInString(s)
+	i := size
+	if isRegionalIndicator(r) && i < len(s) {
+		next, nextSize := utf8.DecodeRuneInString(s[i:])
+		if isRegionalIndicator(next) {
+			return i + nextSize
+		}
+	}
+
+	for i < len(s) {
+		next, nextSize := utf8.DecodeRuneInString(s[i:])
+		if !isGraphemeExtend(next) {
+			break
+		}
+		i += nextSize
+		if next == 0x200d && i < len(s) {
+			_, joinedSize := utf8.DecodeRuneInString(s[i:])
+			i += joinedSize
+		}
+	}
+
+	return i
+}
+
+func graphemePrevLen(s string) int {
+	last := 0
+	for i := 0; i < len(s); i += last {
+		last = graphemeLen(s[i:])
+	}
+	return last
+}
+
+func graphemeWidth(g string) int {
+	if len(g) == 1 {
+		return 1
+	}
+
+	r, _ := utf8.DecodeRuneInString(g)
+	if r == utf8.RuneError || unicode.IsControl(r) {
+		return 1
+	}
+	if strings.ContainsRune(g, 0xfe0f) {
+		return 2
+	}
+	return runeWidth(r)
+}
+
+func stringWidth(s string) int {
+	width := 0
+	for i := 0; i < len(s); {
+		n := graphemeLen(s[i:])
+		width += graphemeWidth(s[i : i+n])
+		i += n
+	}
+	return width
+}
+
+func truncateWidth(s string, width int) string {
+	w := 0
+	for i := 0; i < len(s); {
+		n := graphemeLen(s[i:])
+		w += graphemeWidth(s[i : i+n])
+		if w > width {
+			return s[:i]
+		}
+		i += n
+	}
+	return s
+}
+
+func editorUpdateSyntaxRange(at int, n int) {
+	changed := false
+	for i := at; i < at+n; i++ {
+		changed = editorHighlightRow(editorRow(i))
+	}
+	if changed && at+n < e.buf.numOfRows {
+		editorUpdateSyntax(editorRow(at + n))
+	}
+}
+
 func editorUpdateSyntax(row *EditorRow) {
+	at := editorRowIndex(row)
+	for editorHighlightRow(row) && at+1 < e.buf.numOfRows {
+		at++
+		row = editorRow(at)
+	}
+}
+
+func editorHighlightRow(row *EditorRow) bool {
 	row.hl = make([]byte, row.rSize)
 
 	for i := range row.hl {
 		row.hl[i] = HL_NORMAL
 	}
 
-	if e.syntax == nil {
-		return
+	if e.buf.syntax == nil {
+		return false
 	}
 
-	keywords := e.syntax.keywords
+	keywords := e.buf.syntax.keywords
 
-	scs := e.syntax.singlelineCommentStart
-	mcs := e.syntax.multilineCommentStart
-	mce := e.syntax.multilineCommentEnd
+	scs := e.buf.syntax.singlelineCommentStart
+	mcs := e.buf.syntax.multilineCommentStart
+	mce := e.buf.syntax.multilineCommentEnd
 
 	sccLen := len(scs)
 	mcsLen := len(mcs)
@@ -337,8 +902,8 @@ func editorUpdateSyntax(row *EditorRow) {
 	prevSep := true
 	inString := byte(0)
 	inComment := false
-	if row.idx > 0 {
-		inComment = e.row[row.idx-1].hlOpenComment
+	if at := editorRowIndex(row); at > 0 {
+		inComment = editorRow(at - 1).hlOpenComment
 	}
 
 	i := 0
@@ -387,7 +952,7 @@ func editorUpdateSyntax(row *EditorRow) {
 			}
 		}
 
-		if e.syntax.flags&HL_HIGHTLIGHT_STRINGS != 0 {
+		if e.buf.syntax.flags&HL_HIGHTLIGHT_STRINGS != 0 {
 			if inString != 0 {
 				row.hl[i] = HL_STRING
 				if ch == '\\' && i+1 < row.rSize {
@@ -411,7 +976,7 @@ func editorUpdateSyntax(row *EditorRow) {
 			}
 		}
 
-		if e.syntax.flags&HL_HIGHTLIGHT_NUMBERS != 0 {
+		if e.buf.syntax.flags&HL_HIGHTLIGHT_NUMBERS != 0 {
 			if (unicode.IsDigit(rune(ch)) && (prevSep || prevHl == HL_NUMBER)) ||
 				(ch == '.' && prevHl == HL_NUMBER) {
 				row.hl[i] = HL_NUMBER
@@ -455,15 +1020,14 @@ func editorUpdateSyntax(row *EditorRow) {
 			}
 		}
 
-		prevSep = isSeparator(rune(ch))
-		i++
+		r, size := utf8.DecodeRuneInString(row.render[i:])
+		prevSep = isSeparator(r)
+		i += size
 	}
 
 	changed := row.hlOpenComment != inComment
 	row.hlOpenComment = inComment
-	if changed && row.idx+1 < e.numOfRows {
-		editorUpdateSyntax(&e.row[row.idx+1])
-	}
+	return changed
 }
 
 func editorSyntaxToColor(hl byte) int {
@@ -480,42 +1044,50 @@ func editorSyntaxToColor(hl byte) int {
 		return 35
 	case HL_MATCH:
 		return 34
+	case HL_MATCH_OTHER:
+		return 94
 	default:
 		return 37
 	}
 }
 
 func editorSelectSyntaxHightlight() {
-	e.syntax = nil
-	if e.filename == "" {
+	e.buf.syntax = nil
+	if e.buf.filename == "" && e.syntaxName == "" {
 		return
 	}
 
-	ext := path.Ext(e.filename)
+	ext := path.Ext(e.buf.filename)
 
 	for _, s := range hldb {
+		match := e.syntaxName != "" && s.filetype == e.syntaxName
 		for _, fm := range s.filematch {
 			isExt := fm[0] == '.'
-			if (isExt && ext == fm) || (!isExt && strings.Contains(e.filename, fm)) {
-				e.syntax = &s
-
-				for i := range e.row {
-					editorUpdateSyntax(&e.row[i])
-				}
-				return
+			if e.syntaxName == "" && ((isExt && ext == fm) || (!isExt && strings.Contains(e.buf.filename, fm))) {
+				match = true
 			}
 		}
+
+		if match {
+			e.buf.syntax = &s
+			editorUpdateSyntaxRange(0, e.buf.numOfRows)
+			return
+		}
 	}
 }
 
 func editorRowCxToRx(row *EditorRow, cx int) int {
 	rx := 0
 
-	for i := 0; i < cx; i++ {
+	for i := 0; i < cx && i < row.size; {
+		n := graphemeLen(row.chars[i:])
 		if row.chars[i] == '\t' {
 			rx += (KILO_TAB_STOP - 1) - (rx % KILO_TAB_STOP)
+			rx++
+		} else {
+			rx += graphemeWidth(row.chars[i : i+n])
 		}
-		rx++
+		i += n
 	}
 
 	return rx
@@ -524,50 +1096,167 @@ func editorRowCxToRx(row *EditorRow, cx int) int {
 func editorRowRxToCx(row *EditorRow, rx int) int {
 	curRx := 0
 	cx := 0
-	for cx = 0; cx < row.size; cx++ {
+	for cx < row.size {
+		n := graphemeLen(row.chars[cx:])
 		if row.chars[cx] == '\t' {
-			curRx += (KILO_TAB_STOP - 1) - (cx % KILO_TAB_STOP)
+			curRx += (KILO_TAB_STOP - 1) - (curRx % KILO_TAB_STOP)
+			curRx++
+		} else {
+			curRx += graphemeWidth(row.chars[cx : cx+n])
 		}
-		curRx++
 
 		if curRx > rx {
 			return cx
 		}
+		cx += n
 	}
 
 	return cx
 }
 
-func editorUpdateRow(row *EditorRow) {
-	render := ""
+func editorRowCxToRenderIdx(row *EditorRow, cx int) int {
+	rx := 0
 	idx := 0
-	for _, ch := range row.chars {
-		idx++
-		if ch == '\t' {
-			render += " "
-			for idx%KILO_TAB_STOP != 0 {
-				idx++
-				render += " "
-			}
+
+	for i := 0; i < cx && i < row.size; {
+		n := graphemeLen(row.chars[i:])
+		if row.chars[i] == '\t' {
+			tab := KILO_TAB_STOP - (rx % KILO_TAB_STOP)
+			rx += tab
+			idx += tab
 		} else {
-			render += string(ch)
+			rx += graphemeWidth(row.chars[i : i+n])
+			idx += n
 		}
+		i += n
 	}
 
-	row.render = render
-	row.rSize = len(row.render)
+	return idx
+}
 
+func editorUpdateRow(row *EditorRow) {
+	editorUpdateRender(row)
 	editorUpdateSyntax(row)
 }
 
+func editorUpdateRender(row *EditorRow) {
+	row.render = row.chars
+	if strings.IndexByte(row.chars, '\t') >= 0 {
+		var render strings.Builder
+		rx := 0
+		for i := 0; i < row.size; {
+			n := graphemeLen(row.chars[i:])
+			if row.chars[i] == '\t' {
+				render.WriteByte(' ')
+				rx++
+				for rx%KILO_TAB_STOP != 0 {
+					render.WriteByte(' ')
+					rx++
+				}
+			} else {
+				render.WriteString(row.chars[i : i+n])
+				rx += graphemeWidth(row.chars[i : i+n])
+			}
+			i += n
+		}
+		row.render = render.String()
+	}
+	row.rSize = len(row.render)
+}
+
+func editorBlockIndex(buf *EditorBuffer, at int) int {
+	return sort.Search(len(buf.blocks), func(i int) bool {
+		return buf.blocks[i].start > at
+	}) - 1
+}
+
+func editorBufferRow(buf *EditorBuffer, at int) *EditorRow {
+	blk := buf.blocks[editorBlockIndex(buf, at)]
+	return &blk.rows[at-blk.start]
+}
+
+func editorRow(at int) *EditorRow {
+	return editorBufferRow(e.buf, at)
+}
+
+func editorRowIndex(row *EditorRow) int {
+	return row.block.start + row.idx
+}
+
+func editorRenumberBlock(blk *EditorRowBlock) {
+	for i := range blk.rows {
+		blk.rows[i].block = blk
+		blk.rows[i].idx = i
+	}
+}
+
+func editorShiftBlocks(from int, delta int) {
+	for i := from; i < len(e.buf.blocks); i++ {
+		e.buf.blocks[i].start += delta
+	}
+}
+
+func editorInsertBlockRows(at int, rows []EditorRow) {
+	if len(e.buf.blocks) == 0 {
+		e.buf.blocks = []*EditorRowBlock{{}}
+	}
+
+	b := len(e.buf.blocks) - 1
+	if at < e.buf.numOfRows {
+		b = editorBlockIndex(e.buf, at)
+	}
+	blk := e.buf.blocks[b]
+	blk.rows = slices.Insert(blk.rows, at-blk.start, rows...)
+	editorShiftBlocks(b+1, len(rows))
+	e.buf.numOfRows += len(rows)
+
+	if len(blk.rows) <= KILO_BLOCK_ROWS {
+		editorRenumberBlock(blk)
+		return
+	}
+
+	var split []*EditorRowBlock
+	for i := 0; i < len(blk.rows); i += KILO_BLOCK_ROWS / 2 {
+		end := min(i+KILO_BLOCK_ROWS/2, len(blk.rows))
+		part := &EditorRowBlock{
+			start: blk.start + i,
+			rows:  slices.Clone(blk.rows[i:end]),
+		}
+		editorRenumberBlock(part)
+		split = append(split, part)
+	}
+	e.buf.blocks = slices.Replace(e.buf.blocks, b, b+1, split...)
+}
+
+func editorDelBlockRows(at int, n int) {
+	for n > 0 {
+		b := editorBlockIndex(e.buf, at)
+		blk := e.buf.blocks[b]
+		off := at - blk.start
+		k := min(n, len(blk.rows)-off)
+
+		blk.rows = slices.Delete(blk.rows, off, off+k)
+		editorShiftBlocks(b+1, -k)
+		e.buf.numOfRows -= k
+		n -= k
+
+		if len(blk.rows) == 0 {
+			e.buf.blocks = slices.Delete(e.buf.blocks, b, b+1)
+		} else {
+			editorRenumberBlock(blk)
+		}
+	}
+}
+
 func editorInsertRow(at int, s string) {
-	if at < 0 || at > e.numOfRows {
+	if at < 0 || at > e.buf.numOfRows {
 		return
 	}
 
+	editorUndoRecord(EditorUndoOp{op: UNDO_INSERT_ROW, cy: at, s: s})
+
 	size := len(s)
 	row := EditorRow{
-		idx:           at,
 		size:          size,
 		rSize:         0,
 		chars:         s,
@@ -575,190 +1264,1708 @@ func editorInsertRow(at int, s string) {
 		hlOpenComment: false,
 	}
 
-	if at == e.numOfRows {
-		e.row = append(e.row, row)
-	} else {
-		e.row = append(e.row, row)
-		e.row = append(e.row[:at+1], e.row[at:]...)
-		e.row[at] = row
+	editorInsertBlockRows(at, []EditorRow{row})
+	editorUpdateRow(editorRow(at))
+
+	e.buf.dirty++
+}
+
+func editorDelRow(at int) {
+	if at < 0 || at >= e.buf.numOfRows {
+		return
+	}
+
+	editorUndoRecord(EditorUndoOp{op: UNDO_DEL_ROW, cy: at, s: editorRow(at).chars})
+
+	editorDelBlockRows(at, 1)
+	if at < e.buf.numOfRows {
+		editorUpdateSyntax(editorRow(at))
 	}
 
-	for i := at + 1; i < e.numOfRows; i++ {
-		e.row[i].idx++
+	e.buf.dirty++
+}
+
+func editorInsertRows(at int, lines []string) {
+	if at < 0 || at > e.buf.numOfRows || len(lines) == 0 {
+		return
 	}
 
-	editorUpdateRow(&e.row[at])
+	editorUndoRecord(EditorUndoOp{op: UNDO_INSERT_ROWS, cy: at, lines: lines})
+
+	rows := make([]EditorRow, len(lines))
+	for i, s := range lines {
+		rows[i] = EditorRow{
+			size:  len(s),
+			chars: s,
+		}
+		editorUpdateRender(&rows[i])
+	}
+	editorInsertBlockRows(at, rows)
+	editorUpdateSyntaxRange(at, len(lines))
 
-	e.numOfRows++
-	e.dirty++
+	e.buf.dirty++
 }
 
-func editorDelRow(at int) {
-	if at < 0 || at >= e.numOfRows {
+func editorDelRows(at int, n int) {
+	if at < 0 || n <= 0 || at+n > e.buf.numOfRows {
 		return
 	}
 
-	e.row = append(e.row[:at], e.row[at+1:]...)
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = editorRow(at + i).chars
+	}
+	editorUndoRecord(EditorUndoOp{op: UNDO_DEL_ROWS, cy: at, lines: lines})
 
-	for i := at; i < e.numOfRows-1; i++ {
-		e.row[i].idx--
+	editorDelBlockRows(at, n)
+	if at < e.buf.numOfRows {
+		editorUpdateSyntax(editorRow(at))
 	}
 
-	e.numOfRows--
-	e.dirty++
+	e.buf.dirty++
 }
 
-func editorRowInsertChar(row *EditorRow, at int, ch int) {
+func editorRowInsertString(row *EditorRow, at int, s string) {
 	if at < 0 || at > row.size {
 		at = row.size
 	}
 
-	row.chars = row.chars[0:at] + string(byte(ch)) + row.chars[at:]
-	row.size++
+	editorUndoRecord(EditorUndoOp{op: UNDO_INSERT_STR, cy: editorRowIndex(row), cx: at, s: s})
+
+	row.chars = row.chars[0:at] + s + row.chars[at:]
+	row.size += len(s)
+	editorUpdateRow(row)
+	e.buf.dirty++
+}
+
+func editorRowDelString(row *EditorRow, at int, n int) {
+	if at < 0 || at >= row.size || n <= 0 {
+		return
+	}
+	if at+n > row.size {
+		n = row.size - at
+	}
+
+	editorUndoRecord(EditorUndoOp{op: UNDO_DEL_STR, cy: editorRowIndex(row), cx: at, s: row.chars[at : at+n]})
+
+	row.chars = row.chars[:at] + row.chars[at+n:]
+	row.size -= n
 	editorUpdateRow(row)
-	e.dirty++
+	e.buf.dirty++
+}
+
+func editorRowInsertChar(row *EditorRow, at int, ch int) {
+	editorRowInsertString(row, at, string(rune(ch)))
 }
 
 func editorRowAppendString(row *EditorRow, s string) {
-	row.chars += s
-	row.size += len(s)
-	editorUpdateRow(row)
-	e.dirty++
+	editorRowInsertString(row, row.size, s)
 }
 
 func editorRowDelChar(row *EditorRow, at int) {
 	if at < 0 || at >= row.size {
 		return
 	}
-
-	row.chars = row.chars[:at] + row.chars[at+1:]
-	row.size--
-	editorUpdateRow(row)
-	e.dirty++
+	editorRowDelString(row, at, graphemeLen(row.chars[at:]))
 }
 
 func editorInsertChar(ch int) {
-	if e.cy == e.numOfRows {
-		editorInsertRow(e.numOfRows, "")
+	if e.cy == e.buf.numOfRows {
+		editorInsertRow(e.buf.numOfRows, "")
 	}
 
-	editorRowInsertChar(&e.row[e.cy], e.cx, ch)
-	e.cx++
+	editorRowInsertChar(editorRow(e.cy), e.cx, ch)
+	e.cx += utf8.RuneLen(rune(ch))
+	editorUndoTrackCursor()
 }
 
 func editorInsertNewline() {
 	if e.cx == 0 {
 		editorInsertRow(e.cy, "")
 	} else {
-		row := &e.row[e.cy]
+		row := editorRow(e.cy)
 		editorInsertRow(e.cy+1, row.chars[e.cx:])
-		row = &e.row[e.cy]
-		row.chars = row.chars[:e.cx]
-		row.size = e.cx
-		editorUpdateRow(row)
+		row = editorRow(e.cy)
+		editorRowDelString(row, e.cx, row.size-e.cx)
 	}
 	e.cy++
 	e.cx = 0
+	editorUndoTrackCursor()
 }
 
 func editorDelChar() {
-	if e.cy == e.numOfRows {
+	if e.cy == e.buf.numOfRows {
 		return
 	}
 	if e.cx == 0 && e.cy == 0 {
 		return
 	}
 
-	row := &e.row[e.cy]
+	row := editorRow(e.cy)
 	if e.cx > 0 {
-		editorRowDelChar(row, e.cx-1)
-		e.cx--
+		cx := e.cx - graphemePrevLen(row.chars[:e.cx])
+		editorRowDelChar(row, cx)
+		e.cx = cx
 	} else {
-		e.cx = e.row[e.cy-1].size
-		editorRowAppendString(&e.row[e.cy-1], row.chars)
+		prev := editorRow(e.cy - 1)
+		cx := prev.size
+		editorRowAppendString(prev, row.chars)
 		editorDelRow(e.cy)
 		e.cy--
+		e.cx = cx
 	}
+	editorUndoTrackCursor()
 }
 
-func editorRowsToString() string {
+func editorInsertText(text string) {
+	if e.cy == e.buf.numOfRows {
+		editorInsertRow(e.buf.numOfRows, "")
+	}
+
+	lines := strings.Split(text, "\n")
+	row := editorRow(e.cy)
+	if len(lines) == 1 {
+		editorRowInsertString(row, e.cx, text)
+		e.cx += len(text)
+		editorUndoTrackCursor()
+		return
+	}
+
+	tail := row.chars[e.cx:]
+	editorRowDelString(row, e.cx, row.size-e.cx)
+	editorRowAppendString(row, lines[0])
+
+	last := len(lines) - 1
+	rest := make([]string, last)
+	copy(rest, lines[1:])
+	rest[last-1] += tail
+	editorInsertRows(e.cy+1, rest)
+
+	e.cy += last
+	e.cx = len(lines[last])
+	editorUndoTrackCursor()
+}
+
+func editorRangeText(sy, sx, ey, ex int) string {
+	if sy == ey {
+		return editorRow(sy).chars[sx:ex]
+	}
+
+	var text strings.Builder
+	text.WriteString(editorRow(sy).chars[sx:])
+	for y := sy + 1; y < ey; y++ {
+		text.WriteString("\n")
+		text.WriteString(editorRow(y).chars)
+	}
+	text.WriteString("\n")
+	if ey < e.buf.numOfRows {
+		text.WriteString(editorRow(ey).chars[:ex])
+	}
+	return text.String()
+}
+
+func editorDeleteRange(sy, sx, ey, ex int) {
+	if sy == ey {
+		editorRowDelString(editorRow(sy), sx, ex-sx)
+	} else {
+		tail := ""
+		if ey < e.buf.numOfRows {
+			tail = editorRow(ey).chars[ex:]
+		} else {
+			ey = e.buf.numOfRows - 1
+		}
+		editorDelRows(sy+1, ey-sy)
+		row := editorRow(sy)
+		editorRowDelString(row, sx, row.size-sx)
+		if tail != "" {
+			editorRowAppendString(row, tail)
+		}
+	}
+
+	e.cy = sy
+	e.cx = sx
+	editorUndoTrackCursor()
+}
+
+func editorSetMark(sticky bool) {
+	e.buf.mark = true
+	e.buf.markSticky = sticky
+	e.buf.markCx = e.cx
+	e.buf.markCy = e.cy
+}
+
+func editorClearMark() {
+	e.buf.mark = false
+	e.buf.markSticky = false
+}
+
+func editorSelection() (int, int, int, int, bool) {
+	if !e.buf.mark {
+		return 0, 0, 0, 0, false
+	}
+
+	sy, sx := e.buf.markCy, e.buf.markCx
+	ey, ex := e.cy, e.cx
+	if sy > e.buf.numOfRows {
+		sy, sx = e.buf.numOfRows, 0
+	}
+	if sy < e.buf.numOfRows && sx > editorRow(sy).size {
+		sx = editorRow(sy).size
+	}
+	if sy > ey || (sy == ey && sx > ex) {
+		sy, sx, ey, ex = ey, ex, sy, sx
+	}
+	if sy == ey && sx == ex {
+		return 0, 0, 0, 0, false
+	}
+	if sy == e.buf.numOfRows {
+		return 0, 0, 0, 0, false
+	}
+
+	return sy, sx, ey, ex, true
+}
+
+func editorDeleteSelection() bool {
+	sy, sx, ey, ex, ok := editorSelection()
+	editorClearMark()
+	if !ok {
+		return false
+	}
+
+	editorDeleteRange(sy, sx, ey, ex)
+	return true
+}
+
+func editorClipboardHelper() []string {
+	helpers := map[string][]string{
+		"wl-copy": {"wl-copy"},
+		"xclip":   {"xclip", "-selection", "clipboard"},
+		"xsel":    {"xsel", "--clipboard", "--input"},
+		"pbcopy":  {"pbcopy"},
+	}
+
+	if e.clipboardBackend != "auto" {
+		return helpers[e.clipboardBackend]
+	}
+	if os.Getenv("SSH_TTY") != "" {
+		return nil
+	}
+
+	candidates := []string{"pbcopy"}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		candidates = append(candidates, "wl-copy")
+	}
+	if os.Getenv("DISPLAY") != "" {
+		candidates = append(candidates, "xclip", "xsel")
+	}
+	for _, name := range candidates {
+		if _, err := exec.LookPath(name); err == nil {
+			return helpers[name]
+		}
+	}
+	return nil
+}
+
+func editorSetClipboard(text string) string {
+	e.clipboard = text
+
+	switch e.clipboardBackend {
+	case "none", "internal":
+		return "internal"
+	case "osc52":
+		return editorQueueOsc52(text)
+	}
+
+	helper := editorClipboardHelper()
+	if helper == nil {
+		if e.clipboardBackend != "auto" {
+			return "internal, unknown clipboard backend " + e.clipboardBackend
+		}
+		return editorQueueOsc52(text)
+	}
+
+	cmd := exec.Command(helper[0], helper[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	if err := cmd.Run(); err != nil {
+		return fmt.Sprintf("internal, %s failed: %v", helper[0], err)
+	}
+	return helper[0]
+}
+
+func editorQueueOsc52(text string) string {
+	if len(text) > KILO_OSC52_MAX {
+		return "internal, too large for OSC 52"
+	}
+
+	e.clipboardPending = base64.StdEncoding.EncodeToString([]byte(text))
+	return "osc52"
+}
+
+func editorDrawOsc52(sw io.StringWriter) {
+	if e.clipboardPending == "" {
+		return
+	}
+
+	seq := "\x1b]52;c;" + e.clipboardPending + "\x07"
+	if os.Getenv("TMUX") != "" {
+		seq = "\x1bPtmux;\x1b" + seq + "\x1b\\"
+	}
+	sw.WriteString(seq)
+	e.clipboardPending = ""
+}
+
+func editorCopy() {
+	sy, sx, ey, ex, ok := editorSelection()
+	if !ok {
+		editorSetStatusMessage("No selection")
+		return
+	}
+
+	backend := editorSetClipboard(editorRangeText(sy, sx, ey, ex))
+	editorClearMark()
+	editorSetStatusMessage("Copied %d bytes (%s)", len(e.clipboard), backend)
+}
+
+func editorCut() {
+	sy, sx, ey, ex, ok := editorSelection()
+	if !ok {
+		editorSetStatusMessage("No selection")
+		return
+	}
+
+	backend := editorSetClipboard(editorRangeText(sy, sx, ey, ex))
+	editorUndoCommit()
+	editorDeleteSelection()
+	editorUndoCommit()
+	editorSetStatusMessage("Cut %d bytes (%s)", len(e.clipboard), backend)
+}
+
+func editorPaste() {
+	if e.clipboard == "" {
+		editorSetStatusMessage("Clipboard is empty")
+		return
+	}
+
+	editorPasteText(e.clipboard)
+}
+
+func editorPasteText(text string) {
+	editorUndoCommit()
+	editorDeleteSelection()
+	editorInsertText(text)
+	editorUndoCommit()
+}
+
+func editorUndoRecord(op EditorUndoOp) {
+	if e.buf.undoLocked {
+		return
+	}
+
+	if len(e.buf.redoStack) > 0 {
+		e.buf.redoStack = nil
+		if e.buf.undoSavedLevel > len(e.buf.undoStack) {
+			e.buf.undoSavedLevel = -1
+		}
+	}
+
+	if !e.buf.undoOpen || len(e.buf.undoStack) == 0 {
+		if len(e.buf.undoStack) >= KILO_UNDO_LEVELS {
+			e.buf.undoStack = e.buf.undoStack[1:]
+			e.buf.undoSavedLevel--
+		}
+		e.buf.undoStack = append(e.buf.undoStack, EditorUndoGroup{
+			cxBefore: e.cx,
+			cyBefore: e.cy,
+		})
+		e.buf.undoOpen = true
+	}
+
+	group := &e.buf.undoStack[len(e.buf.undoStack)-1]
+	if n := len(group.ops); n > 0 && op.op == UNDO_INSERT_STR {
+		last := &group.ops[n-1]
+		if last.op == UNDO_INSERT_STR && last.cy == op.cy && last.cx+len(last.s) == op.cx {
+			last.s += op.s
+			return
+		}
+	}
+	group.ops = append(group.ops, op)
+}
+
+func editorUndoTrackCursor() {
+	if e.buf.undoOpen && len(e.buf.undoStack) > 0 {
+		group := &e.buf.undoStack[len(e.buf.undoStack)-1]
+		group.cxAfter = e.cx
+		group.cyAfter = e.cy
+	}
+}
+
+func editorUndoCommit() {
+	e.buf.undoOpen = false
+	e.buf.undoKind = UNDO_KIND_NONE
+}
+
+func editorUndoContinue(kind int) {
+	if kind != e.buf.undoKind {
+		editorUndoCommit()
+	}
+	e.buf.undoKind = kind
+}
+
+func editorUndoReset() {
+	e.buf.undoStack = nil
+	e.buf.redoStack = nil
+	e.buf.undoOpen = false
+	e.buf.undoKind = UNDO_KIND_NONE
+	e.buf.undoSavedLevel = 0
+}
+
+func editorUndoApply(op EditorUndoOp, reverse bool) {
+	kind := op.op
+	if reverse {
+		switch kind {
+		case UNDO_INSERT_ROW:
+			kind = UNDO_DEL_ROW
+		case UNDO_DEL_ROW:
+			kind = UNDO_INSERT_ROW
+		case UNDO_INSERT_STR:
+			kind = UNDO_DEL_STR
+		case UNDO_DEL_STR:
+			kind = UNDO_INSERT_STR
+		case UNDO_INSERT_ROWS:
+			kind = UNDO_DEL_ROWS
+		case UNDO_DEL_ROWS:
+			kind = UNDO_INSERT_ROWS
+		}
+	}
+
+	switch kind {
+	case UNDO_INSERT_ROW:
+		editorInsertRow(op.cy, op.s)
+	case UNDO_DEL_ROW:
+		editorDelRow(op.cy)
+	case UNDO_INSERT_STR:
+		editorRowInsertString(editorRow(op.cy), op.cx, op.s)
+	case UNDO_DEL_STR:
+		editorRowDelString(editorRow(op.cy), op.cx, len(op.s))
+	case UNDO_INSERT_ROWS:
+		editorInsertRows(op.cy, op.lines)
+	case UNDO_DEL_ROWS:
+		editorDelRows(op.cy, len(op.lines))
+	}
+}
+
+func editorUndoUpdateDirty() {
+	if len(e.buf.undoStack) == e.buf.undoSavedLevel {
+		e.buf.dirty = 0
+	}
+}
+
+func editorUndo() {
+	editorUndoCommit()
+	if len(e.buf.undoStack) == 0 {
+		editorSetStatusMessage("Already at oldest change")
+		return
+	}
+
+	group := e.buf.undoStack[len(e.buf.undoStack)-1]
+	e.buf.undoStack = e.buf.undoStack[:len(e.buf.undoStack)-1]
+
+	e.buf.undoLocked = true
+	for i := len(group.ops) - 1; i >= 0; i-- {
+		editorUndoApply(group.ops[i], true)
+	}
+	e.buf.undoLocked = false
+
+	e.buf.redoStack = append(e.buf.redoStack, group)
+	e.cx = group.cxBefore
+	e.cy = group.cyBefore
+	e.cy, e.cx = editorClampCursor(e.buf, e.cy, e.cx)
+	editorUndoUpdateDirty()
+}
+
+func editorRedo() {
+	editorUndoCommit()
+	if len(e.buf.redoStack) == 0 {
+		editorSetStatusMessage("Already at newest change")
+		return
+	}
+
+	group := e.buf.redoStack[len(e.buf.redoStack)-1]
+	e.buf.redoStack = e.buf.redoStack[:len(e.buf.redoStack)-1]
+
+	e.buf.undoLocked = true
+	for _, op := range group.ops {
+		editorUndoApply(op, false)
+	}
+	e.buf.undoLocked = false
+
+	e.buf.undoStack = append(e.buf.undoStack, group)
+	e.cx = group.cxAfter
+	e.cy = group.cyAfter
+	e.cy, e.cx = editorClampCursor(e.buf, e.cy, e.cx)
+	editorUndoUpdateDirty()
+}
+
+func editorRowsToString(buf *EditorBuffer) string {
 	var builder strings.Builder
 
-	for _, r := range e.row {
-		builder.WriteString(r.chars)
-		builder.WriteString("\n")
+	eol := "\n"
+	if buf.format.crlf {
+		eol = "\r\n"
+	}
+	if buf.format.bom {
+		builder.WriteString("\uFEFF")
+	}
+	i := 0
+	for _, blk := range buf.blocks {
+		for _, r := range blk.rows {
+			builder.WriteString(r.chars)
+			if i < buf.numOfRows-1 || !buf.format.noEol {
+				builder.WriteString(eol)
+			}
+			i++
+		}
+	}
+
+	return builder.String()
+}
+
+func editorParseLines(r io.Reader) ([]string, EditorFormat, error) {
+	var lines []string
+	var format EditorFormat
+	crlf := 0
+
+	reader := bufio.NewReaderSize(r, 64*1024)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			if line == "" {
+				break
+			}
+		} else if err != nil {
+			return nil, format, err
+		}
+		if !format.binary && strings.IndexByte(line, 0) >= 0 {
+			format.binary = true
+		}
+		if len(lines) == 0 && strings.HasPrefix(line, "\uFEFF") {
+			format.bom = true
+			line = line[len("\uFEFF"):]
+		}
+		if strings.HasSuffix(line, "\n") {
+			line = line[:len(line)-1]
+			if strings.HasSuffix(line, "\r") {
+				crlf++
+			}
+		} else {
+			format.noEol = true
+		}
+		lines = append(lines, line)
+	}
+
+	newlines := len(lines)
+	if format.noEol {
+		newlines--
+	}
+	if !format.binary && crlf > 0 && crlf*2 >= newlines {
+		format.crlf = true
+		for i, line := range lines {
+			lines[i] = strings.TrimSuffix(line, "\r")
+		}
+	}
+
+	return lines, format, nil
+}
+
+func editorFormatName(format EditorFormat) string {
+	name := "LF"
+	if format.crlf {
+		name = "CRLF"
+	}
+	if format.bom {
+		name += " BOM"
+	}
+	if format.noEol {
+		name += " noeol"
+	}
+	if format.binary {
+		name += " binary"
+	}
+	return name
+}
+
+func editorSetFormat(format EditorFormat) {
+	if format == e.buf.format {
+		return
+	}
+
+	e.buf.format = format
+	e.buf.dirty++
+	e.buf.undoSavedLevel = -1
+	editorSetStatusMessage("File format: %s", editorFormatName(format))
+}
+
+func editorFormatCommand() {
+	editorSetStatusMessage("Format (%s): u = LF | d = CRLF | b = toggle BOM | e = toggle final newline", editorFormatName(e.buf.format))
+	editorRefreshScreen()
+
+	format := e.buf.format
+	ch := editorReadKey()
+	editorSetStatusMessage("")
+	switch ch {
+	case 'u', 'U', 'l', 'L':
+		format.crlf = false
+	case 'd', 'D', 'c', 'C':
+		format.crlf = true
+	case 'b', 'B':
+		format.bom = !format.bom
+	case 'e', 'E', 'n', 'N':
+		format.noEol = !format.noEol
+	}
+	editorSetFormat(format)
+}
+
+func editorOpen(filename string) error {
+	e.buf.filename = filename
+
+	editorSelectSyntaxHightlight()
+
+	lines, format, disk, err := editorReadFile(filename)
+	e.buf.readOnly = e.viewMode
+	if os.IsNotExist(err) {
+		editorSetStatusMessage("New file %s", filename)
+		editorSwapCheck()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	editorInsertRows(0, lines)
+	e.buf.format = format
+	e.buf.disk = disk
+
+	editorUndoReset()
+	e.buf.dirty = 0
+
+	if format.binary {
+		e.buf.readOnly = true
+		editorSetStatusMessage("%s looks like a binary file, opened read-only", filename)
+	} else if unix.Access(filename, unix.W_OK) != nil {
+		e.buf.readOnly = true
+		editorSetStatusMessage("%s is not writable, opened read-only", filename)
+	}
+
+	editorSwapCheck()
+	return nil
+}
+
+func editorOpenText(data []byte) {
+	lines, format, _ := editorParseLines(bytes.NewReader(data))
+	editorInsertRows(0, lines)
+	e.buf.format = format
+	e.buf.readOnly = e.viewMode
+	editorSelectSyntaxHightlight()
+
+	editorUndoReset()
+	e.buf.dirty = 0
+}
+
+func editorReadFile(filename string) ([]string, EditorFormat, *EditorFileStat, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, EditorFormat{}, nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, EditorFormat{}, nil, err
+	}
+
+	h := sha256.New()
+	lines, format, err := editorParseLines(io.TeeReader(f, h))
+	if err != nil {
+		return nil, format, nil, err
+	}
+
+	disk := &EditorFileStat{modTime: info.ModTime(), size: info.Size()}
+	h.Sum(disk.hash[:0])
+	return lines, format, disk, nil
+}
+
+func editorStatFile(filename string) (*EditorFileStat, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &EditorFileStat{modTime: info.ModTime(), size: info.Size(), hash: sha256.Sum256(data)}, nil
+}
+
+func editorDiskChanged(buf *EditorBuffer) bool {
+	if buf.disk == nil || buf.filename == "" {
+		return false
+	}
+
+	info, err := os.Stat(buf.filename)
+	if err != nil {
+		return false
+	}
+	if info.ModTime().Equal(buf.disk.modTime) && info.Size() == buf.disk.size {
+		return false
+	}
+
+	disk, err := editorStatFile(buf.filename)
+	if err != nil {
+		return false
+	}
+	if disk.hash == buf.disk.hash {
+		buf.disk = disk
+		return false
+	}
+	return true
+}
+
+func editorDiskCheck() {
+	if !e.readingCommand || e.buf == nil {
+		return
+	}
+	if e.buf == e.diskCheckBuf && time.Since(e.diskCheckTime) < KILO_DISK_INTERVAL {
+		return
+	}
+	e.diskCheckBuf = e.buf
+	e.diskCheckTime = time.Now()
+
+	if !editorDiskChanged(e.buf) {
+		return
+	}
+
+	e.readingCommand = false
+	editorDiskPrompt(false)
+	e.readingCommand = true
+	editorRefreshScreen()
+}
+
+func editorDiskPrompt(saving bool) bool {
+	buf := e.buf
+	cancel := ""
+	if saving {
+		cancel = " (c)ancel"
+	}
+
+	for {
+		editorSetStatusMessage("%s changed on disk: (r)eload (k)eep ours (d)iff%s", buf.filename, cancel)
+		editorRefreshScreen()
+		ch := editorReadKey()
+		editorSwitchBuffer(buf)
+
+		switch ch {
+		case 'r', 'R':
+			if err := editorReload(); err != nil {
+				editorSetStatusMessage("Can't reload %s: %v", buf.filename, err)
+			} else {
+				editorSetStatusMessage("Reloaded %s, Ctrl-Z to undo", buf.filename)
+			}
+			return false
+
+		case 'k', 'K':
+			if disk, err := editorStatFile(buf.filename); err == nil {
+				buf.disk = disk
+			}
+			if !saving {
+				editorSetStatusMessage("Keeping buffer contents of %s", buf.filename)
+			}
+			return true
+
+		case 'd', 'D':
+			if err := editorDiffBuffer(buf.filename, "buffer", editorRowsToString(buf)); err != nil {
+				editorSetStatusMessage("Can't diff %s: %v", buf.filename, err)
+			}
+
+		case 'c', 'C', '\x1b':
+			if saving {
+				editorSetStatusMessage("Save aborted")
+				return false
+			}
+		}
+	}
+}
+
+func editorReload() error {
+	lines, format, disk, err := editorReadFile(e.buf.filename)
+	if err != nil {
+		return err
+	}
+
+	editorUndoCommit()
+	editorClearMark()
+	editorDelRows(0, e.buf.numOfRows)
+	editorInsertRows(0, lines)
+	e.cy, e.cx = editorClampCursor(e.buf, e.cy, e.cx)
+	if e.layout != nil {
+		for _, w := range editorWindows() {
+			if w != e.win && w.buf == e.buf {
+				w.cy, w.cx = editorClampCursor(w.buf, w.cy, w.cx)
+			}
+		}
+	}
+	editorUndoTrackCursor()
+	editorUndoCommit()
+
+	e.buf.undoSavedLevel = len(e.buf.undoStack)
+	e.buf.dirty = 0
+	e.buf.format = format
+	e.buf.disk = disk
+	return nil
+}
+
+func editorSave() {
+	if e.buf.filename == "" {
+		e.buf.filename = editorPrompt("Save as: %s (ESC to cancel)", nil)
+		if e.buf.filename == "" {
+			editorSetStatusMessage("Save aborted")
+			return
+		}
+		editorSelectSyntaxHightlight()
+	}
+
+	if editorDiskChanged(e.buf) && !editorDiskPrompt(true) {
+		return
+	}
+
+	if dir := filepath.Dir(e.buf.filename); !editorCreateDir(dir) {
+		return
+	}
+
+	data := []byte(editorRowsToString(e.buf))
+
+	n, warning, err := editorWriteFile(e.buf.filename, data)
+	if err != nil {
+		editorSetStatusMessage("Can't save! %v", err)
+		return
+	}
+	if info, err := os.Stat(e.buf.filename); err == nil {
+		e.buf.disk = &EditorFileStat{modTime: info.ModTime(), size: info.Size(), hash: sha256.Sum256(data)}
+	}
+
+	e.buf.dirty = 0
+	editorUndoCommit()
+	e.buf.undoSavedLevel = len(e.buf.undoStack)
+	editorSwapRemove(e.buf)
+	if warning != "" {
+		editorSetStatusMessage("%d bytes written to disk (%s)", n, warning)
+	} else {
+		editorSetStatusMessage("%d bytes written to disk", n)
+	}
+}
+
+func editorCreateDir(dir string) bool {
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return true
+	}
+
+	editorSetStatusMessage("Directory %s does not exist, create it? (y/n)", dir)
+	editorRefreshScreen()
+	ch := editorReadKey()
+	if ch != 'y' && ch != 'Y' {
+		editorSetStatusMessage("Save aborted")
+		return false
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		editorSetStatusMessage("Can't save! %v", err)
+		return false
+	}
+	return true
+}
+
+func editorWriteFile(filename string, data []byte) (int, string, error) {
+	target := filename
+	if resolved, err := filepath.EvalSymlinks(filename); err == nil {
+		target = resolved
+	}
+	dir := filepath.Dir(target)
+
+	mode := os.FileMode(0644)
+	info, statErr := os.Stat(target)
+	if statErr == nil {
+		mode = info.Mode().Perm()
+	} else if !os.IsNotExist(statErr) {
+		return 0, "", fmt.Errorf("stat %s: %w", target, statErr)
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(target)+".kilo-*")
+	if err != nil {
+		if statErr != nil {
+			return 0, "", fmt.Errorf("create temp file: %w", err)
+		}
+		return editorWriteInPlace(target, data, mode, "can't create temp file")
+	}
+	tmp := f.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	n, err := f.Write(data)
+	if err != nil {
+		return 0, "", fmt.Errorf("write %s: %w", tmp, err)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, "", fmt.Errorf("fsync %s: %w", tmp, err)
+	}
+	if err := f.Chmod(mode); err != nil {
+		return 0, "", fmt.Errorf("chmod %s: %w", tmp, err)
+	}
+	if statErr == nil {
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if ok && (int(st.Uid) != os.Getuid() || int(st.Gid) != os.Getgid()) {
+			if err := f.Chown(int(st.Uid), int(st.Gid)); err != nil {
+				return editorWriteInPlace(target, data, mode, "can't preserve ownership")
+			}
+		}
+	}
+	if err := f.Close(); err != nil {
+		return 0, "", fmt.Errorf("close %s: %w", tmp, err)
+	}
+
+	if statErr == nil && e.backup {
+		backup := target + "~"
+		os.Remove(backup)
+		if err := os.Link(target, backup); err != nil {
+			if err := editorCopyFile(target, backup, mode); err != nil {
+				return 0, "", fmt.Errorf("backup %s: %w", backup, err)
+			}
+		}
+	}
+
+	if err := os.Rename(tmp, target); err != nil {
+		return 0, "", fmt.Errorf("rename %s: %w", tmp, err)
+	}
+	committed = true
+
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return n, "", nil
+}
+
+func editorWriteInPlace(target string, data []byte, mode os.FileMode, reason string) (int, string, error) {
+	warning := reason + ", wrote in place"
+	backup := target + "~"
+	if err := editorCopyFile(target, backup, mode); err != nil {
+		for {
+			editorSetStatusMessage("%s and can't write backup %s, overwrite in place? (y/n)", reason, backup)
+			editorRefreshScreen()
+			ch := editorReadKey()
+			if ch == 'y' || ch == 'Y' {
+				break
+			}
+			if ch == 'n' || ch == 'N' || ch == '\x1b' {
+				return 0, "", fmt.Errorf("%s, not overwriting without a backup", reason)
+			}
+		}
+		warning += " without a backup"
+	} else {
+		warning += ", backup in " + filepath.Base(backup)
+	}
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return 0, "", fmt.Errorf("open %s: %w", target, err)
+	}
+
+	n, err := f.Write(data)
+	if err != nil {
+		f.Close()
+		return 0, "", fmt.Errorf("write %s: %w", target, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, "", fmt.Errorf("fsync %s: %w", target, err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, "", fmt.Errorf("close %s: %w", target, err)
+	}
+	return n, warning, nil
+}
+
+func editorCopyFile(src, dst string, mode os.FileMode) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func editorSwapName(filename string) string {
+	dir, base := filepath.Split(filename)
+	return filepath.Join(dir, "."+base+".kilo.swp")
+}
+
+func editorSwapWrite(buf *EditorBuffer) error {
+	name := editorSwapName(buf.filename)
+	if buf.swapFile != "" && buf.swapFile != name {
+		os.Remove(buf.swapFile)
+	}
+
+	data := fmt.Sprintf("kilo swap %d\n", os.Getpid()) + editorRowsToString(buf)
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, []byte(data), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	buf.swapFile = name
+	buf.swapDirty = buf.dirty
+	buf.swapTime = time.Now()
+	return nil
+}
+
+func editorSwapRemove(buf *EditorBuffer) {
+	if buf.swapFile != "" {
+		os.Remove(buf.swapFile)
+		buf.swapFile = ""
+	}
+	buf.swapDirty = 0
+}
+
+func editorSwapUpdate(force bool) {
+	for _, b := range e.buffers {
+		if b.filename == "" || b.swapDisabled {
+			continue
+		}
+		if b.dirty == 0 {
+			editorSwapRemove(b)
+			continue
+		}
+		if b.dirty == b.swapDirty || (!force && time.Since(b.swapTime) < KILO_SWAP_INTERVAL) {
+			continue
+		}
+		if err := editorSwapWrite(b); err != nil {
+			b.swapDisabled = true
+			editorSetStatusMessage("Can't write swap file, crash recovery disabled: %v", err)
+		}
+	}
+}
+
+func editorSwapCheck() {
+	name := editorSwapName(e.buf.filename)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return
+	}
+
+	header, content, _ := strings.Cut(string(data), "\n")
+	var pid int
+	if _, err := fmt.Sscanf(header, "kilo swap %d", &pid); err != nil {
+		return
+	}
+	if pid == os.Getpid() {
+		return
+	}
+	if err := unix.Kill(pid, 0); err == nil || err == unix.EPERM {
+		e.buf.swapDisabled = true
+		editorSetStatusMessage("%s is being edited by process %d, crash recovery disabled", e.buf.filename, pid)
+		return
+	}
+	if content == editorRowsToString(e.buf) {
+		os.Remove(name)
+		return
+	}
+
+	buf := e.buf
+	for {
+		editorSetStatusMessage("Swap file found for %s: (r)ecover (d)iff (x) discard (q) keep", buf.filename)
+		editorRefreshScreen()
+		ch := editorReadKey()
+		editorSwitchBuffer(buf)
+
+		switch ch {
+		case 'r', 'R':
+			lines, format, _ := editorParseLines(strings.NewReader(content))
+			buf.format = format
+			editorDelRows(0, e.buf.numOfRows)
+			editorInsertRows(0, lines)
+			e.cx = 0
+			e.cy = 0
+			editorUndoTrackCursor()
+			editorUndoCommit()
+			editorSetStatusMessage("Recovered %s from swap file, Ctrl-Z to undo", buf.filename)
+			return
+
+		case 'd', 'D':
+			if err := editorDiffBuffer(buf.filename, "swap", content); err != nil {
+				editorSetStatusMessage("Can't diff swap file: %v", err)
+			}
+
+		case 'x', 'X':
+			os.Remove(name)
+			editorSetStatusMessage("Discarded swap file for %s", buf.filename)
+			return
+
+		case 'q', 'Q', '\x1b':
+			buf.swapDisabled = true
+			editorSetStatusMessage("Kept swap file %s, crash recovery disabled", name)
+			return
+		}
+	}
+}
+
+func editorDiffBuffer(filename string, label string, content string) error {
+	f, err := os.CreateTemp("", "kilo-diff-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(content)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	out, err := exec.Command("diff", "-u", "--label", filename, "--label", label, filename, f.Name()).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	lines, format, _ := editorParseLines(bytes.NewReader(out))
+	editorSwitchBuffer(editorNewBuffer())
+	editorInsertRows(0, lines)
+	e.buf.format = format
+	editorUndoReset()
+	e.buf.dirty = 0
+	return nil
+}
+
+func editorNewBuffer() *EditorBuffer {
+	buf := &EditorBuffer{}
+	e.buffers = append(e.buffers, buf)
+	return buf
+}
+
+func editorSwitchBuffer(buf *EditorBuffer) {
+	if e.buf != nil {
+		editorUndoCommit()
+		e.buf.cx = e.cx
+		e.buf.cy = e.cy
+		e.buf.rowOff = e.rowOff
+		e.buf.colOff = e.colOff
+	}
+
+	e.buf = buf
+	e.cy, e.cx = editorClampCursor(buf, buf.cy, buf.cx)
+	e.rowOff = buf.rowOff
+	e.colOff = buf.colOff
+}
+
+func editorCloseBuffer(buf *EditorBuffer) {
+	for i, b := range e.buffers {
+		if b == buf {
+			e.buffers = append(e.buffers[:i], e.buffers[i+1:]...)
+			break
+		}
+	}
+}
+
+func editorBufferIndex(buf *EditorBuffer) int {
+	for i, b := range e.buffers {
+		if b == buf {
+			return i
+		}
+	}
+	return -1
+}
+
+func editorBufferName(buf *EditorBuffer) string {
+	if buf.filename == "" {
+		return "[No Name]"
+	}
+	return buf.filename
+}
+
+func editorCycleBuffer(dir int) {
+	if len(e.buffers) < 2 {
+		editorSetStatusMessage("No other buffers")
+		return
+	}
+
+	i := editorBufferIndex(e.buf) + dir
+	if i < 0 {
+		i = len(e.buffers) - 1
+	} else if i >= len(e.buffers) {
+		i = 0
+	}
+	editorSwitchBuffer(e.buffers[i])
+	editorSetStatusMessage("Buffer %d/%d: %s", i+1, len(e.buffers), editorBufferName(e.buf))
+}
+
+func editorBufferList() {
+	var list strings.Builder
+	for i, b := range e.buffers {
+		if i > 0 {
+			list.WriteString(" ")
+		}
+		list.WriteString(fmt.Sprintf("%d:%s", i+1, editorBufferName(b)))
+		if b.dirty > 0 {
+			list.WriteString("*")
+		}
+	}
+
+	prompt := strings.ReplaceAll(list.String(), "%", "%%") + " | Buffer: %s"
+	choice := editorPrompt(prompt, nil)
+	if choice == "" {
+		return
+	}
+
+	var n int
+	if _, err := fmt.Sscanf(choice, "%d", &n); err == nil && n >= 1 && n <= len(e.buffers) {
+		editorSwitchBuffer(e.buffers[n-1])
+		return
+	}
+	for _, b := range e.buffers {
+		if b.filename == choice || path.Base(b.filename) == choice {
+			editorSwitchBuffer(b)
+			return
+		}
+	}
+	editorSetStatusMessage("No such buffer: %s", choice)
+}
+
+func editorOpenPrompt() {
+	filename := editorPrompt("Open file: %s (ESC to cancel)", nil)
+	if filename == "" {
+		return
+	}
+
+	for _, b := range e.buffers {
+		if b.filename == filename {
+			editorSwitchBuffer(b)
+			return
+		}
+	}
+
+	prev := e.buf
+	buf := editorNewBuffer()
+	editorSwitchBuffer(buf)
+	editorSetStatusMessage("Opened %s", filename)
+	if err := editorOpen(filename); err != nil {
+		editorCloseBuffer(buf)
+		e.buf = nil
+		editorSwitchBuffer(prev)
+		editorSetStatusMessage("Can't open %s: %v", filename, err)
+	}
+}
+
+func editorLoadWindow(w *EditorWindow) {
+	e.win = w
+	e.buf = w.buf
+	e.cx = w.cx
+	e.cy = w.cy
+	e.rx = w.rx
+	e.rowOff = w.rowOff
+	e.colOff = w.colOff
+	e.segOff = w.segOff
+	e.screenRows = w.rows
+	editorUpdateGutter()
+
+	if e.buf != nil {
+		e.cy, e.cx = editorClampCursor(e.buf, e.cy, e.cx)
+	}
+}
+
+func editorStoreWindow(w *EditorWindow) {
+	w.buf = e.buf
+	w.cx = e.cx
+	w.cy = e.cy
+	w.rx = e.rx
+	w.rowOff = e.rowOff
+	w.colOff = e.colOff
+	w.segOff = e.segOff
+}
+
+func editorLayoutWindows(node *EditorLayout, top, left, rows, cols int) {
+	node.top = top
+	node.left = left
+	node.rows = rows
+	node.cols = cols
+
+	switch node.split {
+	case SPLIT_HORIZONTAL:
+		first := int(node.ratio * float64(rows))
+		first = max(2, min(first, rows-2))
+		editorLayoutWindows(node.first, top, left, first, cols)
+		editorLayoutWindows(node.second, top+first, left, rows-first, cols)
+	case SPLIT_VERTICAL:
+		first := int(node.ratio * float64(cols-1))
+		first = max(1, min(first, cols-2))
+		editorLayoutWindows(node.first, top, left, rows, first)
+		editorLayoutWindows(node.second, top, left+first+1, rows, cols-first-1)
+	default:
+		node.win.top = top
+		node.win.left = left
+		node.win.rows = max(rows-1, 0)
+		node.win.cols = cols
+	}
+}
+
+func editorCollectWindows(node *EditorLayout, windows []*EditorWindow) []*EditorWindow {
+	if node.split == SPLIT_NONE {
+		return append(windows, node.win)
+	}
+	windows = editorCollectWindows(node.first, windows)
+	return editorCollectWindows(node.second, windows)
+}
+
+func editorWindows() []*EditorWindow {
+	return editorCollectWindows(e.layout, nil)
+}
+
+func editorFindLayout(node *EditorLayout, w *EditorWindow) *EditorLayout {
+	if node.split == SPLIT_NONE {
+		if node.win == w {
+			return node
+		}
+		return nil
+	}
+	if found := editorFindLayout(node.first, w); found != nil {
+		return found
+	}
+	return editorFindLayout(node.second, w)
+}
+
+func editorDrawSeparators(sw io.StringWriter, node *EditorLayout) {
+	if node.split == SPLIT_NONE {
+		return
+	}
+	if node.split == SPLIT_VERTICAL {
+		x := node.first.left + node.first.cols + 1
+		sw.WriteString("\x1b[7m")
+		for y := 0; y < node.rows; y++ {
+			sw.WriteString(fmt.Sprintf("\x1b[%d;%dH|", node.top+y+1, x))
+		}
+		sw.WriteString("\x1b[m")
+	}
+	editorDrawSeparators(sw, node.first)
+	editorDrawSeparators(sw, node.second)
+}
+
+func editorFocusWindow(w *EditorWindow) {
+	if w == e.win {
+		return
+	}
+	editorUndoCommit()
+	editorStoreWindow(e.win)
+	editorLoadWindow(w)
+}
+
+func editorSplitWindow(split int) {
+	node := editorFindLayout(e.layout, e.win)
+	if (split == SPLIT_HORIZONTAL && node.rows < 4) || (split == SPLIT_VERTICAL && node.cols < 3) {
+		editorSetStatusMessage("Not enough room to split")
+		return
+	}
+
+	editorStoreWindow(e.win)
+	w := *e.win
+	node.first = &EditorLayout{parent: node, win: e.win}
+	node.second = &EditorLayout{parent: node, win: &w}
+	node.win = nil
+	node.split = split
+	node.ratio = 0.5
+
+	editorLayoutWindows(e.layout, 0, 0, e.termRows-1, e.termCols)
+	editorLoadWindow(e.win)
+}
+
+func editorCloseWindow(w *EditorWindow) {
+	node := editorFindLayout(e.layout, w)
+	parent := node.parent
+	if parent == nil {
+		editorSetStatusMessage("Can't close the last window")
+		return
+	}
+
+	sibling := parent.first
+	if sibling == node {
+		sibling = parent.second
+	}
+	sibling.parent = parent.parent
+	if parent.parent == nil {
+		e.layout = sibling
+	} else if parent.parent.first == parent {
+		parent.parent.first = sibling
+	} else {
+		parent.parent.second = sibling
 	}
 
-	return builder.String()
+	editorStoreWindow(e.win)
+	if w == e.win {
+		editorUndoCommit()
+		leaf := sibling
+		for leaf.split != SPLIT_NONE {
+			leaf = leaf.first
+		}
+		e.win = leaf.win
+	}
+	editorLayoutWindows(e.layout, 0, 0, e.termRows-1, e.termCols)
+	editorLoadWindow(e.win)
 }
 
-func editorOpen(filename string) {
-	e.filename = filename
-
-	editorSelectSyntaxHightlight()
+func editorOnlyWindow() {
+	editorStoreWindow(e.win)
+	e.layout = &EditorLayout{win: e.win}
+	editorLayoutWindows(e.layout, 0, 0, e.termRows-1, e.termCols)
+	editorLoadWindow(e.win)
+}
 
-	f, err := os.Open(filename)
-	if err != nil {
-		die("editorOpen", err)
+func editorResizeWindow(split int, delta int) {
+	node := editorFindLayout(e.layout, e.win)
+	for node.parent != nil && node.parent.split != split {
+		node = node.parent
+	}
+	parent := node.parent
+	if parent == nil {
+		return
 	}
-	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		editorInsertRow(e.numOfRows, line)
+	editorStoreWindow(e.win)
+	if parent.second == node {
+		delta = -delta
+	}
+	if split == SPLIT_HORIZONTAL {
+		parent.ratio = float64(parent.first.rows+delta) / float64(parent.rows)
+	} else {
+		parent.ratio = float64(parent.first.cols+delta) / float64(parent.cols-1)
 	}
+	parent.ratio = max(0.0, min(parent.ratio, 1.0))
 
-	e.dirty = 0
+	editorLayoutWindows(e.layout, 0, 0, e.termRows-1, e.termCols)
+	editorLoadWindow(e.win)
 }
 
-func editorSave() {
-	if e.filename == "" {
-		e.filename = editorPrompt("Save as: %s (ESC to cancel)", nil)
-		if e.filename == "" {
-			editorSetStatusMessage("Save aborted")
+func editorCycleWindow(dir int) {
+	editorStoreWindow(e.win)
+	windows := editorWindows()
+	for i, w := range windows {
+		if w == e.win {
+			editorFocusWindow(windows[(i+dir+len(windows))%len(windows)])
 			return
 		}
-		editorSelectSyntaxHightlight()
 	}
+}
 
-	var err error
-	defer func() {
-		if err != nil {
-			editorSetStatusMessage("Can't save! I/O error: %s", err)
-			return
+func editorMoveFocus(key int) {
+	y := e.win.top + e.curRow
+	x := e.win.left + e.gutterWidth + e.curCol
+
+	var best *EditorWindow
+	bestDist := 0
+	for _, w := range editorWindows() {
+		var dist int
+		switch key {
+		case ARROW_UP:
+			dist = e.win.top - (w.top + w.rows + 1)
+		case ARROW_DOWN:
+			dist = w.top - (e.win.top + e.win.rows + 1)
+		case ARROW_LEFT:
+			dist = e.win.left - (w.left + w.cols + 1)
+		case ARROW_RIGHT:
+			dist = w.left - (e.win.left + e.win.cols + 1)
+		}
+		if w == e.win || dist < 0 {
+			continue
 		}
-	}()
 
-	str := editorRowsToString()
+		if key == ARROW_UP || key == ARROW_DOWN {
+			if x < w.left {
+				dist += w.left - x
+			} else if x >= w.left+w.cols {
+				dist += x - (w.left + w.cols - 1)
+			}
+		} else {
+			if y < w.top {
+				dist += w.top - y
+			} else if y > w.top+w.rows {
+				dist += y - (w.top + w.rows)
+			}
+		}
 
-	f, err := os.Create(e.filename)
-	if err != nil {
-		return
+		if best == nil || dist < bestDist {
+			best = w
+			bestDist = dist
+		}
 	}
-	defer f.Close()
 
-	data := []byte(str)
-	err = f.Truncate(int64(len(data)))
-	if err != nil {
-		return
+	if best != nil {
+		editorFocusWindow(best)
 	}
+}
 
-	n, err := f.Write(data)
-	if err != nil {
+func editorWindowCommand() {
+	editorSetStatusMessage("Window: s = split | v = vsplit | c = close | o = only | w = next | +/-/</> = resize | arrows = move")
+	editorRefreshScreen()
+
+	ch := editorReadKey()
+	editorSetStatusMessage("")
+	switch ch {
+	case 's', 'S', int(ctrlKey('s')):
+		editorSplitWindow(SPLIT_HORIZONTAL)
+	case 'v', 'V', int(ctrlKey('v')):
+		editorSplitWindow(SPLIT_VERTICAL)
+	case 'c', 'q', int(ctrlKey('c')):
+		editorCloseWindow(e.win)
+	case 'o', int(ctrlKey('o')):
+		editorOnlyWindow()
+	case 'w', int(ctrlKey('w')):
+		editorCycleWindow(1)
+	case 'W', 'p':
+		editorCycleWindow(-1)
+	case '+':
+		editorResizeWindow(SPLIT_HORIZONTAL, 1)
+	case '-':
+		editorResizeWindow(SPLIT_HORIZONTAL, -1)
+	case '>':
+		editorResizeWindow(SPLIT_VERTICAL, 1)
+	case '<':
+		editorResizeWindow(SPLIT_VERTICAL, -1)
+	case ARROW_UP, 'k':
+		editorMoveFocus(ARROW_UP)
+	case ARROW_DOWN, 'j':
+		editorMoveFocus(ARROW_DOWN)
+	case ARROW_LEFT, 'h':
+		editorMoveFocus(ARROW_LEFT)
+	case ARROW_RIGHT, 'l':
+		editorMoveFocus(ARROW_RIGHT)
+	}
+}
+
+func editorFindCompile(query string) (*regexp.Regexp, error) {
+	pattern := query
+	if !e.findRegex {
+		pattern = regexp.QuoteMeta(query)
+	}
+	if e.findIgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+func editorFindMatches(s string) [][]int {
+	var matches [][]int
+	for _, loc := range e.findPattern.FindAllStringIndex(s, -1) {
+		if loc[1] == loc[0] {
+			continue
+		}
+		if e.findWholeWord {
+			before, _ := utf8.DecodeLastRuneInString(s[:loc[0]])
+			after, _ := utf8.DecodeRuneInString(s[loc[1]:])
+			if isWordChar(before) || isWordChar(after) {
+				continue
+			}
+		}
+		matches = append(matches, loc)
+	}
+	return matches
+}
+
+func editorFindInRow(row *EditorRow) (int, int) {
+	if matches := editorFindMatches(row.chars); len(matches) > 0 {
+		return matches[0][0], matches[0][1]
+	}
+	return -1, -1
+}
+
+func editorFindRanges(row *EditorRow) [][2]int {
+	var ranges [][2]int
+	for _, loc := range editorFindMatches(row.chars) {
+		ranges = append(ranges, [2]int{
+			editorRowCxToRenderIdx(row, loc[0]),
+			editorRowCxToRenderIdx(row, loc[1]),
+		})
+	}
+	return ranges
+}
+
+func editorFindCountMatches() {
+	e.findIndex = 0
+	e.findCount = 0
+	if e.findPattern == nil || e.findQuery == "" {
 		return
 	}
 
-	e.dirty = 0
-	editorSetStatusMessage("%d bytes written to disk", n)
+	for i := 0; i < e.buf.numOfRows; i++ {
+		for range editorFindMatches(editorRow(i).chars) {
+			e.findCount++
+			if i == e.findLastMatch && e.findIndex == 0 {
+				e.findIndex = e.findCount
+			}
+		}
+	}
+}
+
+func editorFindModes() string {
+	var modes []string
+	if e.findRegex {
+		modes = append(modes, "regex")
+	}
+	if e.findIgnoreCase {
+		modes = append(modes, "icase")
+	}
+	if e.findWholeWord {
+		modes = append(modes, "word")
+	}
+	if len(modes) == 0 {
+		return ""
+	}
+	return "[" + strings.Join(modes, ",") + "]"
 }
 
 func editorFindCallback(str string, ch int) {
 	if e.findSavedHl != nil {
-		copy(e.row[e.findSavedHlLine].hl, e.findSavedHl)
+		copy(editorRow(e.findSavedHlLine).hl, e.findSavedHl)
 		e.findSavedHl = nil
 	}
 
+	switch ch {
+	case int(ctrlKey('r')):
+		e.findRegex = !e.findRegex
+	case int(ctrlKey('t')):
+		e.findIgnoreCase = !e.findIgnoreCase
+	case int(ctrlKey('w')):
+		e.findWholeWord = !e.findWholeWord
+	}
+	e.promptInfo = editorFindModes()
+
 	if ch == '\r' || ch == '\x1b' {
 		e.findLastMatch = -1
 		e.findDirection = 1
@@ -775,28 +2982,53 @@ func editorFindCallback(str string, ch int) {
 	if e.findLastMatch == -1 {
 		e.findDirection = 1
 	}
+
+	if str != e.findQuery || e.findPattern == nil || e.findLastMatch == -1 {
+		pattern, err := editorFindCompile(str)
+		if err != nil {
+			msg := err.Error()
+			if serr, ok := err.(*syntax.Error); ok {
+				msg = string(serr.Code)
+			}
+			e.findPattern = nil
+			e.findIndex = 0
+			e.findCount = 0
+			e.promptInfo = strings.TrimSpace(e.promptInfo + " invalid pattern: " + msg)
+			return
+		}
+		e.findPattern = pattern
+		e.findQuery = str
+	}
+	if str == "" {
+		editorFindCountMatches()
+		return
+	}
+	defer editorFindCountMatches()
+
 	current := e.findLastMatch
-	for i := 0; i < e.numOfRows; i++ {
+	for i := 0; i < e.buf.numOfRows; i++ {
 		current += e.findDirection
 		if current < 0 {
-			current = e.numOfRows - 1
-		} else if current >= e.numOfRows {
+			current = e.buf.numOfRows - 1
+		} else if current >= e.buf.numOfRows {
 			current = 0
 		}
 
-		row := &e.row[current]
-		match := strings.Index(row.render, str)
+		row := editorRow(current)
+		match, matchEnd := editorFindInRow(row)
 		if match >= 0 {
 			e.findLastMatch = current
 			e.cy = current
-			e.cx = editorRowRxToCx(row, match)
-			e.rowOff = e.numOfRows
+			e.cx = match
+			e.rowOff = e.buf.numOfRows
 
 			e.findSavedHl = make([]byte, row.rSize)
 			copy(e.findSavedHl, row.hl)
 			e.findSavedHlLine = current
 
-			for i := match; i < match+len(str); i++ {
+			start := editorRowCxToRenderIdx(row, match)
+			end := editorRowCxToRenderIdx(row, matchEnd)
+			for i := start; i < end; i++ {
 				row.hl[i] = HL_MATCH
 			}
 			break
@@ -812,43 +3044,179 @@ func editorFind() {
 
 	e.findLastMatch = -1
 	e.findDirection = 1
+	e.findPattern = nil
+	e.findQuery = ""
+	e.findIndex = 0
+	e.findCount = 0
+	e.findActive = true
+	e.findBuf = e.buf
+	e.promptInfo = editorFindModes()
+
+	query := editorPrompt("Search: %s (^R regex ^T case ^W word)", editorFindCallback)
+	e.findActive = false
+	if query == "" {
+		e.cx = savedCx
+		e.cy = savedCy
+		e.colOff = savedColOff
+		e.rowOff = savedRowOff
+	}
+}
 
-	query := editorPrompt("Search: %s (Use ESC/Arrows/Enter)", editorFindCallback)
+func editorReplace() {
+	query := editorPrompt("Replace: %s (ESC to cancel)", nil)
 	if query == "" {
+		return
+	}
+	replacement, ok := editorPromptInput("Replace "+strings.ReplaceAll(query, "%", "%%")+" with: %s (ESC to cancel)", nil, true)
+	if !ok {
+		return
+	}
+
+	savedCx := e.cx
+	savedCy := e.cy
+	savedColOff := e.colOff
+	savedRowOff := e.rowOff
+
+	editorUndoCommit()
+	editorClearMark()
+
+	startY, startX := e.cy, e.cx
+	y, x := startY, startX
+	wrapped := false
+	replaceAll := false
+	count := 0
+
+	for e.buf.numOfRows > 0 {
+		if y >= e.buf.numOfRows {
+			if wrapped {
+				break
+			}
+			wrapped = true
+			y, x = 0, 0
+		}
+		if wrapped && y > startY {
+			break
+		}
+
+		row := editorRow(y)
+		match := -1
+		if x <= row.size {
+			match = strings.Index(row.chars[x:], query)
+		}
+		if match < 0 || (wrapped && y == startY && x+match >= startX) {
+			y++
+			x = 0
+			continue
+		}
+		match += x
+
+		if !replaceAll {
+			e.cy = y
+			e.cx = match
+			e.rowOff = e.buf.numOfRows
+
+			e.findSavedHl = make([]byte, row.rSize)
+			copy(e.findSavedHl, row.hl)
+			e.findSavedHlLine = y
+			start := editorRowCxToRenderIdx(row, match)
+			end := editorRowCxToRenderIdx(row, match+len(query))
+			for i := start; i < end; i++ {
+				row.hl[i] = HL_MATCH
+			}
+
+			var ch int
+			for {
+				editorSetStatusMessage("Replace this match? (y)es (n)o (a)ll (q)uit")
+				editorRefreshScreen()
+				ch = editorReadKey()
+				if strings.ContainsRune("yYnNaAqQ\x1b", rune(ch)) {
+					break
+				}
+			}
+
+			copy(row.hl, e.findSavedHl)
+			e.findSavedHl = nil
+
+			if ch == 'q' || ch == 'Q' || ch == '\x1b' {
+				break
+			} else if ch == 'a' || ch == 'A' {
+				replaceAll = true
+			} else if ch != 'y' && ch != 'Y' {
+				x = match + len(query)
+				continue
+			}
+		}
+
+		editorRowDelString(row, match, len(query))
+		editorRowInsertString(row, match, replacement)
+		if wrapped && y == startY {
+			startX += len(replacement) - len(query)
+		}
+		x = match + len(replacement)
+		count++
+	}
+
+	if count > 0 {
+		group := &e.buf.undoStack[len(e.buf.undoStack)-1]
+		group.cxBefore = savedCx
+		group.cyBefore = savedCy
+	}
+	editorUndoTrackCursor()
+	editorUndoCommit()
+
+	if count == 0 {
 		e.cx = savedCx
 		e.cy = savedCy
 		e.colOff = savedColOff
 		e.rowOff = savedRowOff
 	}
+	editorSetStatusMessage("Replaced %d occurrence(s)", count)
 }
 
 func editorPrompt(prompt string, callback func(s string, ch int)) string {
+	str, _ := editorPromptInput(prompt, callback, false)
+	return str
+}
+
+func editorPromptInput(prompt string, callback func(s string, ch int), allowEmpty bool) (string, bool) {
 	str := ""
+	defer func() {
+		e.promptInfo = ""
+	}()
+
 	for {
 		editorSetStatusMessage(prompt, str)
+		if e.promptInfo != "" {
+			e.statusMsg += " " + e.promptInfo
+		}
 		editorRefreshScreen()
 
 		ch := editorReadKey()
 		if ch == DEL_KEY || ch == int(ctrlKey('h')) || ch == BACKSPACE {
 			if str != "" {
-				str = str[:len(str)-1]
+				_, size := utf8.DecodeLastRuneInString(str)
+				str = str[:len(str)-size]
 			}
 		} else if ch == '\x1b' {
 			editorSetStatusMessage("")
 			if callback != nil {
 				callback(str, ch)
 			}
-			return ""
+			return "", false
 		} else if ch == '\r' {
-			if str != "" {
+			if str != "" || allowEmpty {
 				editorSetStatusMessage("")
 				if callback != nil {
 					callback(str, ch)
 				}
-				return str
+				return str, true
 			}
-		} else if !unicode.IsControl(rune(ch)) && ch < 128 {
-			str += string(ch)
+		} else if ch == PASTE_EVENT {
+			line, _, _ := strings.Cut(e.pasteText, "\n")
+			str += line
+			e.pasteText = ""
+		} else if !unicode.IsControl(rune(ch)) && ch <= utf8.MaxRune {
+			str += string(rune(ch))
 		}
 
 		if callback != nil {
@@ -859,21 +3227,35 @@ func editorPrompt(prompt string, callback func(s string, ch int)) string {
 
 func editorMoveCursor(key int) {
 	var row *EditorRow
-	if e.cy < e.numOfRows {
-		row = &e.row[e.cy]
+	if e.cy < e.buf.numOfRows {
+		row = editorRow(e.cy)
+	}
+
+	rx := 0
+	if row != nil {
+		rx = editorRowCxToRx(row, e.cx)
+	}
+
+	if e.wrap != WRAP_OFF && (key == ARROW_UP || key == ARROW_DOWN) {
+		if key == ARROW_UP {
+			editorMoveVisual(-1)
+		} else {
+			editorMoveVisual(1)
+		}
+		return
 	}
 
 	switch key {
 	case ARROW_LEFT:
 		if e.cx > 0 {
-			e.cx--
+			e.cx -= graphemePrevLen(row.chars[:e.cx])
 		} else if e.cy > 0 {
 			e.cy--
-			e.cx = e.row[e.cy].size
+			e.cx = editorRow(e.cy).size
 		}
 	case ARROW_RIGHT:
 		if row != nil && e.cx < row.size {
-			e.cx++
+			e.cx += graphemeLen(row.chars[e.cx:])
 		} else if row != nil {
 			e.cy++
 			e.cx = 0
@@ -881,16 +3263,26 @@ func editorMoveCursor(key int) {
 	case ARROW_UP:
 		if e.cy > 0 {
 			e.cy--
+			e.cx = editorRowRxToCx(editorRow(e.cy), rx)
 		}
 	case ARROW_DOWN:
-		if e.cy < e.numOfRows {
+		if e.cy < e.buf.numOfRows {
 			e.cy++
+			if e.cy < e.buf.numOfRows {
+				e.cx = editorRowRxToCx(editorRow(e.cy), rx)
+			}
+		}
+	case HOME_KEY:
+		e.cx = 0
+	case END_KEY:
+		if row != nil {
+			e.cx = row.size
 		}
 	}
 
 	row = nil
-	if e.cy < e.numOfRows {
-		row = &e.row[e.cy]
+	if e.cy < e.buf.numOfRows {
+		row = editorRow(e.cy)
 	}
 
 	rowLen := 0
@@ -902,60 +3294,334 @@ func editorMoveCursor(key int) {
 	}
 }
 
+func editorClampCursor(buf *EditorBuffer, cy, cx int) (int, int) {
+	if cy > buf.numOfRows {
+		cy = buf.numOfRows
+	}
+	if cy == buf.numOfRows {
+		cx = 0
+	} else if cx > editorBufferRow(buf, cy).size {
+		cx = editorBufferRow(buf, cy).size
+	}
+	return cy, cx
+}
+
+func editorScreenToPos(y, x int) (int, int) {
+	if e.buf.numOfRows == 0 {
+		return 0, 0
+	}
+	y = max(0, min(y, e.screenRows-1))
+	x = max(0, x)
+
+	fileRow, seg := e.rowOff, 0
+	if e.wrap != WRAP_OFF {
+		seg = e.segOff
+		for ; y > 0 && fileRow < e.buf.numOfRows; y-- {
+			seg++
+			if seg >= editorVisualLines(fileRow) {
+				fileRow++
+				seg = 0
+			}
+		}
+	} else {
+		fileRow += y
+	}
+	if fileRow >= e.buf.numOfRows {
+		fileRow = e.buf.numOfRows - 1
+		seg = editorVisualLines(fileRow) - 1
+	}
+
+	row := editorRow(fileRow)
+	rx := e.colOff + x
+	if e.wrap != WRAP_OFF {
+		segs := editorRowWrap(row, e.screenCols)
+		rx = segs[seg][1] + x
+		if seg+1 < len(segs) && rx >= segs[seg+1][1] {
+			rx = segs[seg+1][1] - 1
+		}
+	}
+
+	return fileRow, editorRowRxToCx(row, rx)
+}
+
+func editorScrollView(lines int) {
+	if e.wrap != WRAP_OFF {
+		for ; lines < 0; lines++ {
+			if e.segOff > 0 {
+				e.segOff--
+			} else if e.rowOff > 0 {
+				e.rowOff--
+				e.segOff = editorVisualLines(e.rowOff) - 1
+			}
+		}
+		for ; lines > 0 && e.rowOff < e.buf.numOfRows; lines-- {
+			e.segOff++
+			if e.segOff >= editorVisualLines(e.rowOff) {
+				e.rowOff++
+				e.segOff = 0
+			}
+		}
+	} else {
+		e.rowOff = max(0, min(e.rowOff+lines, e.buf.numOfRows-1))
+	}
+
+	topY, topX := editorScreenToPos(0, e.curCol)
+	bottomY, bottomX := editorScreenToPos(e.screenRows-1, e.curCol)
+	if e.cy < topY || (e.cy == topY && e.cx < topX) {
+		e.cy, e.cx = topY, topX
+	} else if e.cy > bottomY || (e.cy == bottomY && e.cx > bottomX) {
+		e.cy, e.cx = bottomY, bottomX
+	}
+}
+
+func editorWindowAt(y, x int) *EditorWindow {
+	for _, w := range editorWindows() {
+		if x >= w.left && x < w.left+w.cols && y >= w.top && y <= w.top+w.rows {
+			return w
+		}
+	}
+	return nil
+}
+
+func editorProcessMouse() {
+	button := e.mouseButton &^ (4 | 8 | 16)
+	drag := button&32 != 0
+	button &^= 32
+
+	if button == 64 || button == 65 {
+		if w := editorWindowAt(e.mouseY, e.mouseX); w != nil {
+			editorFocusWindow(w)
+		}
+		if button == 64 {
+			editorScrollView(-3)
+		} else {
+			editorScrollView(3)
+		}
+		return
+	}
+
+	if button != 0 {
+		return
+	}
+
+	if !drag && !e.mouseRelease {
+		if w := editorWindowAt(e.mouseY, e.mouseX); w != nil {
+			editorFocusWindow(w)
+		}
+		editorScroll()
+	}
+
+	y := e.mouseY - e.win.top
+	x := e.mouseX - e.win.left - e.gutterWidth
+	cy, cx := editorScreenToPos(y, x)
+
+	if e.mouseRelease {
+		if e.buf.mark && e.buf.markCy == e.cy && e.buf.markCx == e.cx {
+			editorClearMark()
+		}
+		return
+	}
+
+	if drag {
+		if !e.buf.mark {
+			editorSetMark(false)
+		}
+	} else {
+		editorClearMark()
+	}
+	e.cy = cy
+	e.cx = cx
+}
+
+func editorCheckWritable() bool {
+	if !e.buf.readOnly {
+		return true
+	}
+	editorSetStatusMessage("Buffer is read-only, press Ctrl-U to allow editing")
+	return false
+}
+
+func editorToggleReadOnly() {
+	e.buf.readOnly = !e.buf.readOnly
+	if e.buf.readOnly {
+		editorSetStatusMessage("Read-only mode on")
+	} else {
+		editorSetStatusMessage("Read-only mode off")
+	}
+}
+
 func editorProcessKeypress() {
+	e.readingCommand = true
 	ch := editorReadKey()
+	e.readingCommand = false
 
+	editing := false
 	switch ch {
 	case '\r':
+		if !editorCheckWritable() {
+			break
+		}
+		editorUndoCommit()
+		editorDeleteSelection()
 		editorInsertNewline()
+		editorUndoCommit()
 		break
 
 	case int(ctrlKey('q')):
-		if e.dirty > 0 && e.quitTimes > 0 {
-			editorSetStatusMessage("WARNING!!! File has unsaved changes. Press Ctrl-Q %d more times to quit.", e.quitTimes)
+		var modified []string
+		for _, b := range e.buffers {
+			if b.dirty > 0 {
+				modified = append(modified, editorBufferName(b))
+			}
+		}
+		if len(modified) > 0 && e.quitTimes > 0 {
+			if len(e.buffers) == 1 {
+				editorSetStatusMessage("WARNING!!! File has unsaved changes. Press Ctrl-Q %d more times to quit.", e.quitTimes)
+			} else {
+				editorSetStatusMessage("WARNING!!! %d buffers have unsaved changes (%s). Press Ctrl-Q %d more times to quit.",
+					len(modified), strings.Join(modified, ", "), e.quitTimes)
+			}
 			e.quitTimes--
 			return
 		}
+		for _, b := range e.buffers {
+			editorSwapRemove(b)
+		}
 		os.Stdout.WriteString("\x1b[2J")
 		os.Stdout.WriteString("\x1b[H")
+		disableRawMode()
 		os.Exit(0)
 
 	case int(ctrlKey('s')):
+		if !editorCheckWritable() {
+			break
+		}
 		editorSave()
 
 	case ARROW_UP,
 		ARROW_DOWN,
 		ARROW_LEFT,
-		ARROW_RIGHT:
+		ARROW_RIGHT,
+		HOME_KEY,
+		END_KEY:
+		if e.buf.mark && !e.buf.markSticky {
+			editorClearMark()
+		}
 		editorMoveCursor(ch)
 
-	case HOME_KEY:
-		e.cx = 0
+	case SHIFT_ARROW_UP,
+		SHIFT_ARROW_DOWN,
+		SHIFT_ARROW_LEFT,
+		SHIFT_ARROW_RIGHT,
+		SHIFT_HOME,
+		SHIFT_END:
+		if !e.buf.mark {
+			editorSetMark(false)
+		}
+		switch ch {
+		case SHIFT_ARROW_UP:
+			editorMoveCursor(ARROW_UP)
+		case SHIFT_ARROW_DOWN:
+			editorMoveCursor(ARROW_DOWN)
+		case SHIFT_ARROW_LEFT:
+			editorMoveCursor(ARROW_LEFT)
+		case SHIFT_ARROW_RIGHT:
+			editorMoveCursor(ARROW_RIGHT)
+		case SHIFT_HOME:
+			editorMoveCursor(HOME_KEY)
+		case SHIFT_END:
+			editorMoveCursor(END_KEY)
+		}
 
-	case END_KEY:
-		if e.cy < e.numOfRows {
-			e.cx = e.row[e.cy].size
+	case 0:
+		if e.buf.mark {
+			editorClearMark()
+			editorSetStatusMessage("Mark cleared")
+		} else {
+			editorSetMark(true)
+			editorSetStatusMessage("Mark set")
+		}
+
+	case int(ctrlKey('c')):
+		editorCopy()
+
+	case int(ctrlKey('x')):
+		if !editorCheckWritable() {
+			break
 		}
+		editorCut()
+
+	case int(ctrlKey('v')):
+		if !editorCheckWritable() {
+			break
+		}
+		editorPaste()
 
 	case int(ctrlKey('f')):
 		editorFind()
 
+	case int(ctrlKey('r')):
+		if !editorCheckWritable() {
+			break
+		}
+		editorReplace()
+
+	case int(ctrlKey('o')):
+		editorOpenPrompt()
+
+	case int(ctrlKey('n')):
+		editorCycleBuffer(1)
+
+	case int(ctrlKey('p')):
+		editorCycleBuffer(-1)
+
+	case int(ctrlKey('b')):
+		editorBufferList()
+
+	case int(ctrlKey('w')):
+		editorWindowCommand()
+
+	case int(ctrlKey('z')):
+		if !editorCheckWritable() {
+			break
+		}
+		editorClearMark()
+		editorUndo()
+
+	case int(ctrlKey('y')):
+		if !editorCheckWritable() {
+			break
+		}
+		editorClearMark()
+		editorRedo()
+
 	case BACKSPACE,
 		int(ctrlKey('h')),
 		DEL_KEY:
+		if !editorCheckWritable() {
+			break
+		}
+		if _, _, _, _, ok := editorSelection(); ok {
+			editorUndoCommit()
+			editorDeleteSelection()
+			break
+		}
+		editorUndoContinue(UNDO_KIND_DELETE)
 		if ch == DEL_KEY {
 			editorMoveCursor(ARROW_RIGHT)
 		}
 		editorDelChar()
+		editing = true
 		break
 
 	case PAGE_UP, PAGE_DOWN:
 		if ch == PAGE_UP {
-			e.cy = e.rowOff
+			for i := 0; i < e.curRow; i++ {
+				editorMoveCursor(ARROW_UP)
+			}
 		} else if ch == PAGE_DOWN {
-			e.cy = e.rowOff + e.screenRows - 1
-			if e.cy > e.numOfRows {
-				e.cy = e.numOfRows
+			for i := e.curRow; i < e.screenRows-1; i++ {
+				editorMoveCursor(ARROW_DOWN)
 			}
 		}
 
@@ -969,20 +3635,231 @@ func editorProcessKeypress() {
 			times--
 		}
 
-	case int(ctrlKey('l')), '\x1b':
+	case MOUSE_EVENT:
+		editorProcessMouse()
+
+	case PASTE_EVENT:
+		if editorCheckWritable() {
+			editorPasteText(e.pasteText)
+		}
+		e.pasteText = ""
+
+	case int(ctrlKey('t')):
+		editorToggleLineNumbers()
+
+	case int(ctrlKey('e')):
+		editorToggleWrap()
+
+	case int(ctrlKey('k')):
+		if !editorCheckWritable() {
+			break
+		}
+		editorFormatCommand()
+
+	case int(ctrlKey('u')):
+		editorToggleReadOnly()
+
+	case int(ctrlKey('g')):
+		editorGotoLine()
+
+	case int(ctrlKey('l')):
 		break
 
+	case '\x1b':
+		editorClearMark()
+
 	default:
+		if !editorCheckWritable() {
+			break
+		}
+		editorUndoContinue(UNDO_KIND_INSERT)
+		editorDeleteSelection()
 		editorInsertChar(ch)
+		if isSeparator(rune(ch)) {
+			editorUndoCommit()
+		} else {
+			editing = true
+		}
+	}
+
+	if !editing {
+		editorUndoCommit()
 	}
 
 	e.quitTimes = KILO_QUIT_TIMES
 }
 
+func editorUpdateGutter() {
+	e.gutterWidth = 0
+	if e.lineNumbers != LINE_NUMBERS_OFF && e.buf != nil {
+		digits := len(fmt.Sprint(e.buf.numOfRows))
+		e.gutterWidth = max(digits, 3) + 1
+		if e.gutterWidth >= e.win.cols {
+			e.gutterWidth = 0
+		}
+	}
+	e.screenCols = e.win.cols - e.gutterWidth
+}
+
+func editorToggleLineNumbers() {
+	e.lineNumbers = (e.lineNumbers + 1) % 4
+	editorUpdateGutter()
+
+	switch e.lineNumbers {
+	case LINE_NUMBERS_OFF:
+		editorSetStatusMessage("Line numbers off")
+	case LINE_NUMBERS_ABSOLUTE:
+		editorSetStatusMessage("Line numbers: absolute")
+	case LINE_NUMBERS_RELATIVE:
+		editorSetStatusMessage("Line numbers: relative")
+	case LINE_NUMBERS_HYBRID:
+		editorSetStatusMessage("Line numbers: hybrid")
+	}
+}
+
+func editorDrawGutter(sw io.StringWriter, fileRow int) {
+	if e.gutterWidth == 0 {
+		return
+	}
+	if fileRow >= e.buf.numOfRows {
+		sw.WriteString(strings.Repeat(" ", e.gutterWidth))
+		return
+	}
+
+	n := fileRow + 1
+	if e.lineNumbers == LINE_NUMBERS_RELATIVE || (e.lineNumbers == LINE_NUMBERS_HYBRID && fileRow != e.cy) {
+		n = fileRow - e.cy
+		if n < 0 {
+			n = -n
+		}
+	}
+
+	if fileRow == e.cy {
+		sw.WriteString("\x1b[33m")
+	} else {
+		sw.WriteString("\x1b[90m")
+	}
+	sw.WriteString(fmt.Sprintf("%*d ", e.gutterWidth-1, n))
+	sw.WriteString("\x1b[39m")
+}
+
+func editorRowWrap(row *EditorRow, width int) [][2]int {
+	segs := [][2]int{{0, 0}}
+	if width <= 0 {
+		return segs
+	}
+
+	start, startCol := 0, 0
+	brk, brkCol := -1, 0
+	col := 0
+	for j := 0; j < row.rSize; {
+		n := graphemeLen(row.render[j:])
+		w := graphemeWidth(row.render[j : j+n])
+		if col+w-startCol > width && j > start {
+			if e.wrap == WRAP_WORD && brk > start {
+				start, startCol = brk, brkCol
+			} else {
+				start, startCol = j, col
+			}
+			segs = append(segs, [2]int{start, startCol})
+			brk = -1
+			continue
+		}
+
+		col += w
+		j += n
+		if row.render[j-n] == ' ' {
+			brk, brkCol = j, col
+		}
+	}
+	if col-startCol >= width {
+		segs = append(segs, [2]int{row.rSize, col})
+	}
+
+	return segs
+}
+
+func editorRowSegment(segs [][2]int, rx int) int {
+	i := len(segs) - 1
+	for i > 0 && segs[i][1] > rx {
+		i--
+	}
+	return i
+}
+
+func editorVisualLines(fileRow int) int {
+	if fileRow >= e.buf.numOfRows {
+		return 1
+	}
+	return len(editorRowWrap(editorRow(fileRow), e.screenCols))
+}
+
+func editorToggleWrap() {
+	e.wrap = (e.wrap + 1) % 3
+	e.colOff = 0
+	e.segOff = 0
+
+	switch e.wrap {
+	case WRAP_OFF:
+		editorSetStatusMessage("Soft wrap off")
+	case WRAP_CHAR:
+		editorSetStatusMessage("Soft wrap on")
+	case WRAP_WORD:
+		editorSetStatusMessage("Soft wrap on (word boundaries)")
+	}
+}
+
+func editorMoveVisual(dir int) {
+	rx := 0
+	segs := [][2]int{{0, 0}}
+	if e.cy < e.buf.numOfRows {
+		rx = editorRowCxToRx(editorRow(e.cy), e.cx)
+		segs = editorRowWrap(editorRow(e.cy), e.screenCols)
+	}
+	cs := editorRowSegment(segs, rx)
+	col := rx - segs[cs][1]
+
+	y, t := e.cy, cs+dir
+	if t < 0 {
+		if y == 0 {
+			return
+		}
+		y--
+		t = editorVisualLines(y) - 1
+	} else if t >= len(segs) {
+		if y >= e.buf.numOfRows {
+			return
+		}
+		y++
+		t = 0
+	}
+
+	e.cy = y
+	e.cx = 0
+	if y >= e.buf.numOfRows {
+		return
+	}
+
+	row := editorRow(y)
+	tsegs := editorRowWrap(row, e.screenCols)
+	target := tsegs[t][1] + col
+	if t+1 < len(tsegs) && target >= tsegs[t+1][1] {
+		target = tsegs[t+1][1] - 1
+	}
+	e.cx = editorRowRxToCx(row, target)
+}
+
 func editorScroll() {
+	editorUpdateGutter()
+
 	e.rx = 0
-	if e.cy < e.numOfRows {
-		e.rx = editorRowCxToRx(&e.row[e.cy], e.cx)
+	if e.cy < e.buf.numOfRows {
+		e.rx = editorRowCxToRx(editorRow(e.cy), e.cx)
+	}
+
+	if e.wrap != WRAP_OFF {
+		editorScrollWrapped()
+		return
 	}
 
 	if e.cy < e.rowOff {
@@ -993,23 +3870,189 @@ func editorScroll() {
 	}
 
 	if e.rx < e.colOff {
-		e.colOff = 0
+		e.colOff = e.rx
 	}
 	if e.rx >= e.colOff+e.screenCols {
 		e.colOff = e.rx - e.screenCols + 1
 	}
+
+	e.curRow = e.cy - e.rowOff
+	e.curCol = e.rx - e.colOff
+}
+
+func editorScrollWrapped() {
+	e.colOff = 0
+
+	segs := [][2]int{{0, 0}}
+	if e.cy < e.buf.numOfRows {
+		segs = editorRowWrap(editorRow(e.cy), e.screenCols)
+	}
+	cs := editorRowSegment(segs, e.rx)
+
+	if e.rowOff > e.buf.numOfRows {
+		e.rowOff = e.buf.numOfRows
+	}
+	if n := editorVisualLines(e.rowOff); e.segOff >= n {
+		e.segOff = n - 1
+	}
+	if e.cy < e.rowOff || (e.cy == e.rowOff && cs < e.segOff) {
+		e.rowOff = e.cy
+		e.segOff = cs
+	}
+
+	lines := 0
+	y, sub := e.rowOff, e.segOff
+	for y < e.cy && lines < e.screenRows {
+		lines += editorVisualLines(y) - sub
+		sub = 0
+		y++
+	}
+	lines += cs - sub
+
+	if lines >= e.screenRows {
+		y, sub = e.cy, cs
+		for k := e.screenRows - 1; k > 0; k-- {
+			if sub > 0 {
+				sub--
+			} else {
+				y--
+				sub = editorVisualLines(y) - 1
+			}
+		}
+		e.rowOff = y
+		e.segOff = sub
+		lines = e.screenRows - 1
+	}
+
+	e.curRow = lines
+	e.curCol = e.rx - segs[cs][1]
+}
+
+func editorDrawRowSpan(sw io.StringWriter, fileRow int, j, col, end, colOff int) int {
+	row := editorRow(fileRow)
+
+	selStart, selEnd := -1, -1
+	if sy, sx, ey, ex, ok := editorSelection(); ok && fileRow >= sy && fileRow <= ey {
+		selStart = 0
+		if fileRow == sy {
+			selStart = editorRowCxToRenderIdx(row, sx)
+		}
+		selEnd = row.rSize
+		if fileRow == ey {
+			selEnd = editorRowCxToRenderIdx(row, ex)
+		}
+	}
+
+	var matches [][2]int
+	if e.findActive && e.findBuf == e.buf && e.findPattern != nil && e.findQuery != "" {
+		matches = editorFindRanges(row)
+	}
+
+	currentColor := -1
+	inverse := false
+	for j < end {
+		n := graphemeLen(row.render[j:])
+		g := row.render[j : j+n]
+		w := graphemeWidth(g)
+		if col+w > colOff+e.screenCols {
+			break
+		}
+		if col < colOff {
+			if col+w > colOff {
+				sw.WriteString(strings.Repeat(" ", col+w-colOff))
+			}
+			col += w
+			j += n
+			continue
+		}
+
+		if inSel := j >= selStart && j < selEnd; inSel != inverse {
+			if inSel {
+				sw.WriteString("\x1b[7m")
+			} else {
+				sw.WriteString("\x1b[27m")
+			}
+			inverse = inSel
+		}
+
+		hl := row.hl[j]
+		for len(matches) > 0 && matches[0][1] <= j {
+			matches = matches[1:]
+		}
+		if len(matches) > 0 && j >= matches[0][0] && hl != HL_MATCH {
+			hl = HL_MATCH_OTHER
+		}
+
+		ch, size := utf8.DecodeRuneInString(g)
+		if unicode.IsControl(ch) || (ch == utf8.RuneError && size == 1) {
+			sym := rune('?')
+			if ch <= 26 {
+				sym = '@' + ch
+			}
+
+			sw.WriteString("\x1b[7m")
+			sw.WriteString(string(sym))
+			sw.WriteString("\x1b[m")
+
+			if currentColor != -1 {
+				sw.WriteString(fmt.Sprintf("\x1b[%dm", currentColor))
+			}
+			if inverse {
+				sw.WriteString("\x1b[7m")
+			}
+		} else if hl == HL_NORMAL {
+			if currentColor != -1 {
+				sw.WriteString("\x1b[39m")
+				currentColor = -1
+			}
+			sw.WriteString(g)
+		} else {
+			color := editorSyntaxToColor(hl)
+			if color != currentColor {
+				sw.WriteString(fmt.Sprintf("\x1b[%dm", color))
+				currentColor = color
+			}
+			sw.WriteString(g)
+		}
+
+		col += w
+		j += n
+	}
+	if inverse {
+		sw.WriteString("\x1b[27m")
+	}
+	sw.WriteString("\x1b[39m")
+
+	return max(col-colOff, 0)
 }
 
 func editorDrawRows(sw io.StringWriter) {
+	fileRow := e.rowOff
+	var segs [][2]int
+	seg := 0
+	if e.wrap != WRAP_OFF {
+		seg = e.segOff
+	}
+
 	for y := 0; y < e.screenRows; y++ {
-		fileRow := y + e.rowOff
-		if fileRow >= e.numOfRows {
-			if e.numOfRows == 0 && y == e.screenRows/3 {
+		sw.WriteString(fmt.Sprintf("\x1b[%d;%dH", e.win.top+y+1, e.win.left+1))
+
+		if e.wrap != WRAP_OFF && fileRow < e.buf.numOfRows && segs == nil {
+			segs = editorRowWrap(editorRow(fileRow), e.screenCols)
+		}
+
+		width := 0
+		if seg == 0 {
+			editorDrawGutter(sw, fileRow)
+		} else {
+			sw.WriteString(strings.Repeat(" ", e.gutterWidth))
+		}
+
+		if fileRow >= e.buf.numOfRows {
+			if e.buf.numOfRows == 0 && y == e.screenRows/3 {
 				welcome := fmt.Sprintf("Kilo editor -- version %s", KILO_VERSION)
-				if len(welcome) > e.screenCols {
-					welcome = welcome[:e.screenCols]
-				}
-				padding := (e.screenCols - len(welcome)) / 2
+				welcome = truncateWidth(welcome, e.screenCols)
+				padding := (e.screenCols - stringWidth(welcome)) / 2
 				if padding > 0 {
 					sw.WriteString("~")
 					padding--
@@ -1019,128 +4062,115 @@ func editorDrawRows(sw io.StringWriter) {
 					padding--
 				}
 				sw.WriteString(welcome)
+				width = (e.screenCols-stringWidth(welcome))/2 + stringWidth(welcome)
 			} else {
 				sw.WriteString("~")
+				width = 1
 			}
-		} else {
-			rowLen := e.row[fileRow].rSize
-			if rowLen < 0 {
-				rowLen = 0
-			}
-			if rowLen > e.screenCols {
-				rowLen = e.screenCols
-			}
-			rowStart := e.colOff
-			if rowStart < 0 {
-				rowStart = 0
-			}
-			if rowStart > rowLen {
-				rowStart = rowLen
-			}
-			str := e.row[fileRow].render[rowStart:rowLen]
-			hl := e.row[fileRow].hl[rowStart:rowLen]
-			currentColor := -1
-			for j, ch := range str {
-				if unicode.IsControl(ch) {
-					sym := rune('?')
-					if ch <= 26 {
-						sym = '@' + ch
-					}
-
-					sw.WriteString("\x1b[7m")
-					sw.WriteString(string(sym))
-					sw.WriteString("\x1b[m")
+			fileRow++
+		} else if e.wrap != WRAP_OFF {
+			end := editorRow(fileRow).rSize
+			if seg+1 < len(segs) {
+				end = segs[seg+1][0]
+			}
+			width = editorDrawRowSpan(sw, fileRow, segs[seg][0], segs[seg][1], end, segs[seg][1])
 
-					if currentColor != -1 {
-						sw.WriteString(fmt.Sprintf("\x1b[%dm", currentColor))
-					}
-				} else if hl[j] == HL_NORMAL {
-					if currentColor != -1 {
-						sw.WriteString("\x1b[39m")
-						currentColor = -1
-					}
-					sw.WriteString(string(ch))
-				} else {
-					color := editorSyntaxToColor(hl[j])
-					if color != currentColor {
-						sw.WriteString(fmt.Sprintf("\x1b[%dm", color))
-						currentColor = color
-					}
-					sw.WriteString(string(ch))
-				}
+			seg++
+			if seg >= len(segs) {
+				fileRow++
+				seg = 0
+				segs = nil
 			}
-			sw.WriteString("\x1b[39m")
+		} else {
+			width = editorDrawRowSpan(sw, fileRow, 0, 0, editorRow(fileRow).rSize, e.colOff)
+			fileRow++
 		}
 
-		sw.WriteString("\x1b[K")
-		sw.WriteString("\r\n")
+		if width < e.screenCols {
+			sw.WriteString(strings.Repeat(" ", e.screenCols-width))
+		}
 	}
 }
 
-func editorDrawStatusBar(sw io.StringWriter) {
+func editorDrawStatusBar(sw io.StringWriter, active bool) {
+	sw.WriteString(fmt.Sprintf("\x1b[%d;%dH", e.win.top+e.win.rows+1, e.win.left+1))
 	sw.WriteString("\x1b[7m")
+	if active {
+		sw.WriteString("\x1b[1m")
+	}
 	sx := 0
 
-	name := e.filename
-	if name == "" {
-		name = "[No Name]"
-	}
+	name := editorBufferName(e.buf)
 	dirty := ""
-	if e.dirty > 0 {
+	if e.buf.dirty > 0 {
 		dirty = "(modified)"
 	}
-	status := fmt.Sprintf("%.20s - %d lines %s", name, e.numOfRows, dirty)
-	sx = len(status)
-	if sx > e.screenCols {
-		sx = e.screenCols
+	if e.buf.readOnly {
+		dirty = strings.TrimSpace(dirty + " [RO]")
+	}
+	status := fmt.Sprintf("%.20s - %d lines %s", name, e.buf.numOfRows, dirty)
+	if len(e.buffers) > 1 {
+		status = fmt.Sprintf("[%d/%d] %s", editorBufferIndex(e.buf)+1, len(e.buffers), status)
 	}
-	sw.WriteString(status[:sx])
+	status = truncateWidth(status, e.win.cols)
+	sx = stringWidth(status)
+	sw.WriteString(status)
 
 	fileType := "no ft"
-	if e.syntax != nil {
-		fileType = e.syntax.filetype
+	if e.buf.syntax != nil {
+		fileType = e.buf.syntax.filetype
 	}
 
-	rStatus := fmt.Sprintf("%s | %d/%d", fileType, e.cy+1, e.numOfRows)
-	rLen := len(rStatus)
+	rStatus := fmt.Sprintf("%s | %s | %d/%d", fileType, editorFormatName(e.buf.format), e.cy+1, e.buf.numOfRows)
+	if e.findActive && e.findBuf == e.buf && e.findQuery != "" {
+		rStatus = fmt.Sprintf("%d of %d matches | %s", e.findIndex, e.findCount, rStatus)
+	}
+	rLen := stringWidth(rStatus)
 
-	for ; sx < e.screenCols; sx++ {
-		if e.screenCols-sx == rLen {
-			sw.WriteString(rStatus[:rLen])
+	for ; sx < e.win.cols; sx++ {
+		if e.win.cols-sx == rLen {
+			sw.WriteString(rStatus)
 			break
 		}
 		sw.WriteString(" ")
 	}
 	sw.WriteString("\x1b[m")
-	sw.WriteString("\r\n")
 }
 
 func editorDrawMessageBar(sw io.StringWriter) {
+	sw.WriteString(fmt.Sprintf("\x1b[%d;1H", e.termRows))
 	sw.WriteString("\x1b[K")
-	msgLen := len(e.statusMsg)
-	if msgLen > e.screenCols {
-		msgLen = e.screenCols
-	}
-	if msgLen > 0 && (time.Now().Sub(e.statusMsgTime)).Seconds() < 5 {
-		sw.WriteString(e.statusMsg[:msgLen])
+	msg := truncateWidth(e.statusMsg, e.termCols)
+	if msg != "" && (time.Now().Sub(e.statusMsgTime)).Seconds() < 5 {
+		sw.WriteString(msg)
 	}
 }
 
 func editorRefreshScreen() {
-	editorScroll()
+	editorStoreWindow(e.win)
+	editorLayoutWindows(e.layout, 0, 0, e.termRows-1, e.termCols)
 
 	buff := bytes.NewBuffer([]byte{})
 
 	buff.WriteString("\x1b[?25l")
 	buff.WriteString("\x1b[H")
 
-	editorDrawRows(buff)
-	editorDrawStatusBar(buff)
+	active := e.win
+	for _, w := range editorWindows() {
+		editorLoadWindow(w)
+		editorScroll()
+		editorStoreWindow(w)
+		editorDrawRows(buff)
+		editorDrawStatusBar(buff, w == active)
+	}
+	editorLoadWindow(active)
+	editorDrawSeparators(buff, e.layout)
 	editorDrawMessageBar(buff)
+	editorDrawOsc52(buff)
 
 	buff.WriteString(fmt.Sprintf("\x1b[%d;%dH",
-		(e.cy - e.rowOff + 1),
-		(e.rx - e.colOff + 1)))
+		(e.win.top + e.curRow + 1),
+		(e.win.left + e.gutterWidth + e.curCol + 1)))
 	buff.WriteString("\x1b[?25h")
 
 	os.Stdout.WriteString(buff.String())
@@ -1157,34 +4187,312 @@ func initEditor() {
 	e.rx = 0
 	e.rowOff = 0
 	e.colOff = 0
-	e.numOfRows = 0
-	e.dirty = 0
+	e.buf = nil
+	e.buffers = nil
 	e.quitTimes = KILO_QUIT_TIMES
-	e.syntax = nil
+
+	e.backup = os.Getenv("KILO_BACKUP") != ""
+
+	e.clipboardBackend = os.Getenv("KILO_CLIPBOARD")
+	if e.clipboardBackend == "" {
+		e.clipboardBackend = "auto"
+	}
 
 	c, r, err := getWindowSize()
 	if err != nil {
 		die("getWindowSize", err)
 	}
 
-	e.screenCols = c
-	e.screenRows = r - 2
+	e.winch = make(chan os.Signal, 1)
+	signal.Notify(e.winch, unix.SIGWINCH)
+
+	e.term = make(chan os.Signal, 1)
+	signal.Notify(e.term, unix.SIGHUP, unix.SIGTERM)
+
+	e.termCols = c
+	e.termRows = r
+
+	e.win = &EditorWindow{}
+	e.layout = &EditorLayout{win: e.win}
+	editorLayoutWindows(e.layout, 0, 0, e.termRows-1, e.termCols)
+	editorLoadWindow(e.win)
+}
+
+type EditorOpenArg struct {
+	filename string
+	line     int
+	col      int
+	pattern  string
+}
+
+const KILO_USAGE = `Usage: kilo [options] [+N | +/pattern] [file[:line[:col]] | -]...
+
+Options:
+  +N                 start at line N of the next file
+  +/pattern          start at the first match of pattern in the next file
+  file:line[:col]    open file at the given line and column
+  -                  read a buffer from standard input
+  -R, --readonly     open files read-only
+  -s, --syntax NAME  use syntax highlighting NAME regardless of file name
+  -h, --help         show this help and exit
+      --version      show version information and exit
+`
+
+func editorParseArgs(args []string) ([]EditorOpenArg, error) {
+	var files []EditorOpenArg
+	var pending EditorOpenArg
+	options := true
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if options && strings.HasPrefix(arg, "+") && len(arg) > 1 {
+			if strings.HasPrefix(arg, "+/") {
+				pending.pattern = arg[2:]
+				continue
+			}
+			n, err := strconv.Atoi(arg[1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid line number: %s", arg)
+			}
+			pending.line = n
+			continue
+		}
+
+		if options && strings.HasPrefix(arg, "-") && arg != "-" {
+			name, value, hasValue := strings.Cut(arg, "=")
+			switch name {
+			case "--":
+				options = false
+			case "-h", "--help":
+				fmt.Print(KILO_USAGE)
+				os.Exit(0)
+			case "--version":
+				fmt.Printf("kilo %s\n", KILO_VERSION)
+				os.Exit(0)
+			case "-R", "--readonly":
+				e.viewMode = true
+			case "-s", "--syntax":
+				if !hasValue {
+					if i+1 >= len(args) {
+						return nil, fmt.Errorf("option %s requires an argument", name)
+					}
+					i++
+					value = args[i]
+				}
+				if !slices.ContainsFunc(hldb, func(s EditorSyntax) bool { return s.filetype == value }) {
+					return nil, fmt.Errorf("unknown syntax: %s", value)
+				}
+				e.syntaxName = value
+			default:
+				return nil, fmt.Errorf("unknown option: %s", arg)
+			}
+			continue
+		}
+
+		pending.filename = arg
+		if arg != "-" && pending.line == 0 {
+			pending.filename, pending.line, pending.col = editorSplitPosition(arg)
+		}
+		files = append(files, pending)
+		pending = EditorOpenArg{}
+	}
+
+	if pending.line > 0 || pending.pattern != "" {
+		files = append(files, pending)
+	}
+	return files, nil
+}
+
+func editorSplitPosition(arg string) (string, int, int) {
+	if _, err := os.Stat(arg); err == nil {
+		return arg, 0, 0
+	}
+
+	filename := strings.TrimSuffix(arg, ":")
+	var nums []int
+	for len(nums) < 2 {
+		i := strings.LastIndexByte(filename, ':')
+		if i <= 0 {
+			break
+		}
+		n, err := strconv.Atoi(filename[i+1:])
+		if err != nil || n < 1 {
+			break
+		}
+		nums = append([]int{n}, nums...)
+		filename = filename[:i]
+	}
+
+	switch len(nums) {
+	case 1:
+		return filename, nums[0], 0
+	case 2:
+		return filename, nums[0], nums[1]
+	}
+	return arg, 0, 0
+}
+
+func editorCheckFile(filename string) error {
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", filename)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func editorGotoPosition(line, col int) {
+	e.cy = min(max(line-1, 0), max(e.buf.numOfRows-1, 0))
+	e.cx = 0
+	if e.cy < e.buf.numOfRows {
+		row := editorRow(e.cy)
+		for e.cx < row.size {
+			n := graphemeLen(row.chars[e.cx:])
+			if e.cx+n > col-1 {
+				break
+			}
+			e.cx += n
+		}
+	}
+	e.rowOff = max(e.cy-e.screenRows/2, 0)
+	e.segOff = 0
+}
+
+func editorGotoLine() {
+	query := editorPrompt("Go to line: %s (line[:col], +N, -N, N%%)", nil)
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return
+	}
+
+	line, col := 0, 0
+	var err error
+	switch {
+	case strings.HasSuffix(query, "%"):
+		var percent int
+		percent, err = strconv.Atoi(strings.TrimSuffix(query, "%"))
+		line = max(percent*e.buf.numOfRows/100, 1)
+	case query[0] == '+' || query[0] == '-':
+		var delta int
+		delta, err = strconv.Atoi(query)
+		line = e.cy + 1 + delta
+	default:
+		lineStr, colStr, hasCol := strings.Cut(query, ":")
+		line, err = strconv.Atoi(lineStr)
+		if err == nil && hasCol {
+			col, err = strconv.Atoi(colStr)
+		}
+	}
+	if err != nil {
+		editorSetStatusMessage("Invalid line: %s", query)
+		return
+	}
+
+	if e.buf.mark && !e.buf.markSticky {
+		editorClearMark()
+	}
+	editorGotoPosition(line, 0)
+	if col > 0 && e.cy < e.buf.numOfRows {
+		e.cx = editorRowRxToCx(editorRow(e.cy), col-1)
+	}
+}
+
+func editorGotoPattern(pattern string) {
+	re, err := editorFindCompile(pattern)
+	if err != nil {
+		editorSetStatusMessage("Invalid pattern: %v", err)
+		return
+	}
+
+	for i := 0; i < e.buf.numOfRows; i++ {
+		if loc := re.FindStringIndex(editorRow(i).chars); loc != nil {
+			editorGotoPosition(i+1, loc[0]+1)
+			return
+		}
+	}
+	editorSetStatusMessage("Pattern not found: %s", pattern)
 }
 
 func main() {
+	e.tty = os.Stdin
+
+	files, err := editorParseArgs(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kilo: %v\nTry 'kilo --help' for more information.\n", err)
+		os.Exit(2)
+	}
+
+	var stdinData []byte
+	for _, f := range files {
+		if f.filename == "-" && e.tty == os.Stdin {
+			data, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "kilo: reading stdin: %v\n", err)
+				os.Exit(1)
+			}
+			tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "kilo: %v\n", err)
+				os.Exit(1)
+			}
+			stdinData = data
+			e.tty = tty
+		} else if f.filename != "" && f.filename != "-" {
+			if err := editorCheckFile(f.filename); err != nil {
+				fmt.Fprintf(os.Stderr, "kilo: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+
 	enableRawMode()
 	defer disableRawMode()
 
 	initEditor()
 
-	if len(os.Args) > 1 {
-		editorOpen(os.Args[1])
-	}
+	editorSetStatusMessage("HELP: Ctrl-S = save | Ctrl-Q = quit | Ctrl-F = find | Ctrl-R = replace | Ctrl-O = open | Ctrl-N/P/B = buffers | Ctrl-W = windows | Ctrl-X/C/V = cut/copy/paste | Ctrl-Z/Y = undo/redo")
+
+	for _, f := range files {
+		editorSwitchBuffer(editorNewBuffer())
+		if f.filename == "-" {
+			editorOpenText(stdinData)
+		} else if f.filename != "" {
+			if err := editorOpen(f.filename); err != nil {
+				die("editorOpen", err)
+			}
+		} else {
+			e.buf.readOnly = e.viewMode
+			editorSelectSyntaxHightlight()
+		}
 
-	editorSetStatusMessage("HELP: Ctrl-S = save | Ctrl-Q = quit | Ctrl-F = find")
+		if f.pattern != "" {
+			editorGotoPattern(f.pattern)
+		} else if f.line > 0 {
+			editorGotoPosition(f.line, f.col)
+		}
+	}
+	if len(e.buffers) == 0 {
+		editorSwitchBuffer(editorNewBuffer())
+		e.buf.readOnly = e.viewMode
+		editorSelectSyntaxHightlight()
+	} else {
+		editorSwitchBuffer(e.buffers[0])
+	}
 
 	for {
 		editorRefreshScreen()
 		editorProcessKeypress()
+		editorSwapUpdate(false)
 	}
 }
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const benchLines = 1000000
+
+func writeBenchFile(b *testing.B, name string, comments bool) string {
+	b.Helper()
+
+	var text strings.Builder
+	for i := 0; i < benchLines; i++ {
+		if comments && i%10 == 0 {
+			text.WriteString("/* block\n")
+			text.WriteString("   comment */\n")
+			i++
+			continue
+		}
+		fmt.Fprintf(&text, "int line%d = %d; // generated\n", i, i)
+	}
+
+	filename := filepath.Join(b.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(text.String()), 0644); err != nil {
+		b.Fatal(err)
+	}
+	return filename
+}
+
+func resetEditor() {
+	e = EditorConfig{}
+	e.buf = &EditorBuffer{}
+	e.buffers = []*EditorBuffer{e.buf}
+	e.screenRows = 24
+	e.screenCols = 80
+}
+
+func openBenchFile(b *testing.B, filename string) {
+	b.Helper()
+
+	resetEditor()
+	if err := editorOpen(filename); err != nil {
+		b.Fatal(err)
+	}
+	if e.buf.numOfRows != benchLines {
+		b.Fatalf("loaded %d rows, want %d", e.buf.numOfRows, benchLines)
+	}
+}
+
+func benchmarkOpen(b *testing.B, name string, comments bool) {
+	filename := writeBenchFile(b, name, comments)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		openBenchFile(b, filename)
+	}
+}
+
+func BenchmarkOpen1M(b *testing.B) {
+	benchmarkOpen(b, "plain.txt", false)
+}
+
+func BenchmarkOpen1MComments(b *testing.B) {
+	benchmarkOpen(b, "comments.c", true)
+}
+
+func BenchmarkInsertDeleteRow1M(b *testing.B) {
+	openBenchFile(b, writeBenchFile(b, "rows.c", true))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		at := i * 7919 % e.buf.numOfRows
+		editorInsertRow(at, "inserted")
+		editorDelRow(at)
+	}
+}
+
+func BenchmarkNewlineJoin1M(b *testing.B) {
+	openBenchFile(b, writeBenchFile(b, "newline.c", true))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.cy = i * 7919 % (e.buf.numOfRows - 1)
+		e.cx = 3
+		editorInsertNewline()
+		editorDelChar()
+		editorUndoCommit()
+	}
+}
+
+func BenchmarkTypeChar1M(b *testing.B) {
+	openBenchFile(b, writeBenchFile(b, "type.c", true))
+	e.cy = benchLines / 2
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.cx = 0
+		editorInsertChar('x')
+		editorDelChar()
+	}
+}
+
+func BenchmarkUndoRedo1M(b *testing.B) {
+	openBenchFile(b, writeBenchFile(b, "undo.c", true))
+	e.cy = 0
+	e.cx = 0
+	editorInsertNewline()
+	editorInsertChar('/')
+	editorInsertChar('*')
+	editorUndoCommit()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		editorUndo()
+		editorRedo()
+	}
+}
+
+func TestRowBlocksMatchSlice(t *testing.T) {
+	resetEditor()
+	rng := rand.New(rand.NewSource(1))
+
+	var want []string
+	for i := 0; i < 2000; i++ {
+		at := rng.Intn(len(want) + 1)
+		switch op := rng.Intn(4); {
+		case op == 0 && len(want) > 0:
+			at = rng.Intn(len(want))
+			n := min(rng.Intn(3*KILO_BLOCK_ROWS), len(want)-at)
+			editorDelRows(at, n)
+			want = append(want[:at], want[at+n:]...)
+		case op == 1:
+			lines := make([]string, rng.Intn(3*KILO_BLOCK_ROWS))
+			for j := range lines {
+				lines[j] = fmt.Sprintf("bulk %d.%d", i, j)
+			}
+			editorInsertRows(at, lines)
+			want = append(want[:at], append(lines, want[at:]...)...)
+		default:
+			line := fmt.Sprintf("row %d", i)
+			editorInsertRow(at, line)
+			want = append(want[:at], append([]string{line}, want[at:]...)...)
+		}
+	}
+
+	if e.buf.numOfRows != len(want) {
+		t.Fatalf("numOfRows = %d, want %d", e.buf.numOfRows, len(want))
+	}
+	for i, line := range want {
+		row := editorRow(i)
+		if row.chars != line {
+			t.Fatalf("row %d = %q, want %q", i, row.chars, line)
+		}
+		if editorRowIndex(row) != i {
+			t.Fatalf("row %d reports index %d", i, editorRowIndex(row))
+		}
+	}
+}
+
+func TestGotoPositionKeepsGraphemes(t *testing.T) {
+	resetEditor()
+	editorInsertRows(0, []string{"héllo", "x👍🏽y"})
+
+	tests := []struct {
+		line, col int
+		cx        int
+	}{
+		{1, 1, 0},
+		{1, 3, 1},
+		{1, 4, 3},
+		{1, 99, 6},
+		{2, 4, 1},
+		{2, 10, 9},
+	}
+	for _, tt := range tests {
+		editorGotoPosition(tt.line, tt.col)
+		if e.cx != tt.cx {
+			t.Errorf("editorGotoPosition(%d, %d): cx = %d, want %d", tt.line, tt.col, e.cx, tt.cx)
+		}
+	}
+}
+
+func TestUndoJoinRestoresCursor(t *testing.T) {
+	resetEditor()
+	editorInsertRows(0, []string{"abcdef", "x"})
+	editorUndoReset()
+
+	e.cy, e.cx = 1, 0
+	editorDelChar()
+	if e.cy != 0 || e.cx != 6 || editorRow(0).chars != "abcdefx" {
+		t.Fatalf("join: cursor (%d,%d), row %q", e.cy, e.cx, editorRow(0).chars)
+	}
+
+	editorUndo()
+	if e.buf.numOfRows != 2 || editorRow(0).chars != "abcdef" || editorRow(1).chars != "x" {
+		t.Fatalf("undo: rows not restored")
+	}
+	if e.cy != 1 || e.cx != 0 {
+		t.Fatalf("undo: cursor (%d,%d), want (1,0)", e.cy, e.cx)
+	}
+
+	editorRedo()
+	if e.cy != 0 || e.cx != 6 {
+		t.Fatalf("redo: cursor (%d,%d), want (0,6)", e.cy, e.cx)
+	}
+
+	editorUndo()
+	editorMoveCursor(ARROW_LEFT)
+	editorDelChar()
+	if e.cy != 0 || e.cx != 5 || editorRow(0).chars != "abcde" {
+		t.Fatalf("backspace after undo: cursor (%d,%d), row %q", e.cy, e.cx, editorRow(0).chars)
+	}
+}
+
+func TestReloadClampsCursors(t *testing.T) {
+	resetEditor()
+	filename := filepath.Join(t.TempDir(), "shrink.txt")
+	if err := os.WriteFile(filename, []byte("one\ntwo\nthree\nfour\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := editorOpen(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	e.win = &EditorWindow{buf: e.buf}
+	other := &EditorWindow{buf: e.buf, cy: 2, cx: 5}
+	e.layout = &EditorLayout{
+		split:  SPLIT_HORIZONTAL,
+		first:  &EditorLayout{win: e.win},
+		second: &EditorLayout{win: other},
+	}
+	e.cy, e.cx = 3, 4
+
+	if err := os.WriteFile(filename, []byte("x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := editorReload(); err != nil {
+		t.Fatal(err)
+	}
+	if e.cy != 1 || e.cx != 0 {
+		t.Errorf("cursor (%d,%d), want (1,0)", e.cy, e.cx)
+	}
+	if other.cy != 1 || other.cx != 0 {
+		t.Errorf("other window cursor (%d,%d), want (1,0)", other.cy, other.cx)
+	}
+	editorMoveCursor(ARROW_LEFT)
+}
+
+func TestLoadWindowClampsCursor(t *testing.T) {
+	resetEditor()
+	editorInsertRows(0, []string{"abcd", "efgh", "ijkl"})
+
+	w := &EditorWindow{buf: e.buf, cy: 2, cx: 4}
+	editorDelRows(1, 2)
+	editorLoadWindow(w)
+	if e.cy != 1 || e.cx != 0 {
+		t.Fatalf("cursor (%d,%d), want (1,0)", e.cy, e.cx)
+	}
+	editorInsertChar('x')
+	editorDelChar()
+}
+
+func TestDeleteRowsRehighlights(t *testing.T) {
+	resetEditor()
+	e.buf.filename = "test.c"
+	editorSelectSyntaxHightlight()
+	editorInsertRows(0, []string{"int x;"})
+
+	for _, del := range []func(){
+		func() { editorDelRows(0, 2) },
+		func() { editorDelRow(0); editorDelRow(0) },
+	} {
+		editorInsertRows(0, []string{"/* y", "z"})
+		if editorRow(2).hl[0] != HL_MLCOMMENT {
+			t.Fatalf("int x; not highlighted as comment after /* y")
+		}
+		del()
+		if row := editorRow(0); row.chars != "int x;" || row.hl[0] == HL_MLCOMMENT {
+			t.Fatalf("row %q still highlighted as comment", row.chars)
+		}
+	}
+}
+
+func TestFindWholeWordUnicode(t *testing.T) {
+	resetEditor()
+	e.findWholeWord = true
+
+	tests := []struct {
+		query, s string
+		want     int
+	}{
+		{"été", "a été b", 1},
+		{"hé", "héllo hé", 1},
+		{"foo", "foo_bar foo2 foo", 1},
+		{"x", "x,x", 2},
+	}
+	for _, tt := range tests {
+		pattern, err := editorFindCompile(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.findPattern = pattern
+		if got := len(editorFindMatches(tt.s)); got != tt.want {
+			t.Errorf("%q in %q: %d matches, want %d", tt.query, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestUndoBackspaceRestoresCursor(t *testing.T) {
+	resetEditor()
+	editorInsertRows(0, []string{"abé"})
+	editorUndoReset()
+
+	e.cy, e.cx = 0, 4
+	editorDelChar()
+	if e.cx != 2 || editorRow(0).chars != "ab" {
+		t.Fatalf("backspace: cx = %d, row %q", e.cx, editorRow(0).chars)
+	}
+	editorUndo()
+	if e.cx != 4 || editorRow(0).chars != "abé" {
+		t.Fatalf("undo: cx = %d, row %q", e.cx, editorRow(0).chars)
+	}
+}